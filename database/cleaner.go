@@ -11,6 +11,10 @@ func InitAutoCleaner(db *gorm.DB) {
 		for {
 			db.Exec("DELETE FROM mail_boxes WHERE expires_at <> \"0001-01-01 00:00:00+00:00\" AND ? > expires_at", time.Now())
 
+			// Raw messages are shared between mails, so they're only gone once no mail uses them.
+			// They're stored before their mails are, recent ones may still be waiting for theirs
+			db.Exec("DELETE FROM raw_messages WHERE created_at < ? AND id NOT IN (SELECT raw_message_id FROM mails WHERE raw_message_id IS NOT NULL)", time.Now().Add(-time.Hour))
+
 			time.Sleep(time.Hour * 1)
 		}
 	}()
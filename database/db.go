@@ -2,6 +2,7 @@ package database
 
 import (
 	"errors"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -10,27 +11,122 @@ import (
 )
 
 type MailBox struct {
+	ID               string       `gorm:"type:varchar(36)" json:"id"`
+	Name             string       `json:"name"`
+	Address          string       `gorm:"index" json:"address"` // Unique among the mailboxes sharing a domain
+	MatchType        string       `gorm:"default:exact" json:"match_type"`
+	Domains          []Domain     `gorm:"many2many:mail_box_domains;constraint:OnDelete:CASCADE;" json:"domains"` // None means all of them
+	Addresses        []string     `gorm:"-" json:"addresses"`
+	SMTPUsers        []SMTPUser   `gorm:"constraint:OnDelete:SET NULL;" json:"-"`
+	Capture          bool         `gorm:"default:false" json:"capture"` // Holds the mail an SMTP user submits, never receives mail from outside
+	Emails           []Mail       `gorm:"constraint:OnDelete:CASCADE;" json:"emails"`
+	Locked           bool         `json:"locked"`
+	LockedBehavior   string       `gorm:"default:discard" json:"locked_behavior"`
+	MaxMessageBytes  int          `json:"max_message_bytes"` // Size limit of the mails it accepts, 0 meaning the server's
+	RejectedOversize uint         `json:"rejected_oversize"` // How many mails were turned away for being too big
+	FaultRules       []FaultRule  `gorm:"constraint:OnDelete:CASCADE;" json:"fault_rules"`
+	SenderRules      []SenderRule `gorm:"constraint:OnDelete:CASCADE;" json:"sender_rules"`
+	UnreadCount      uint         `json:"unread_count"`
+	CreatedAt        time.Time    `gorm:"autoCreateTime" json:"created_at"`
+	LastEmailAt      time.Time    `json:"last_email_at"`
+	ExpiresAt        time.Time    `json:"expires_at"`
+}
+
+type Mail struct {
+	ID             string         `gorm:"type:varchar(36)" json:"id"`
+	Subject        string         `json:"subject"`
+	From           string         `json:"from"`             // Envelope sender (MAIL FROM)
+	To             string         `gorm:"index" json:"to"`  // Envelope recipient (RCPT TO)
+	Tag            string         `gorm:"index" json:"tag"` // Sub-address of the recipient ("run123" in "qa+run123@")
+	HeaderFrom     AddressList    `json:"header_from"`
+	HeaderTo       AddressList    `json:"header_to"`
+	HeaderCc       AddressList    `json:"header_cc"`
+	ReplyTo        AddressList    `json:"reply_to"`
+	MessageID      string         `gorm:"index" json:"message_id"`
+	InReplyTo      string         `json:"in_reply_to"`
+	References     StringList     `json:"references"`
+	SenderMismatch bool           `json:"sender_mismatch"` // The envelope sender's domain doesn't match the From header's
+	Authentication Authentication `gorm:"embedded;embeddedPrefix:auth_" json:"authentication"`
+	Envelope       Envelope       `gorm:"embedded;embeddedPrefix:envelope_" json:"envelope"`
+	Body           string         `json:"body"`
+	HTMLBody       string         `json:"html_body"`
+	TextBody       string         `json:"text_body"`
+	Headers        string         `json:"headers"`
+	HeaderFields   []MailHeader   `gorm:"constraint:OnDelete:CASCADE;" json:"header_fields"`
+	Attachments    []Attachment   `gorm:"constraint:OnDelete:CASCADE;" json:"attachments"`
+	RawMessageID   string         `gorm:"index" json:"-"`
+	Read           bool           `json:"read"`
+	CreatedAt      time.Time      `gorm:"autoCreateTime" json:"created_at"`
+	MailBoxID      string         `json:"mailbox_id"`
+}
+
+// SPF, DKIM and DMARC verdict computed when the mail was received, results are
+// RFC 8601 result values ("pass", "fail", "none", "temperror"...)
+type Authentication struct {
+	SPF         string     `json:"spf"`
+	SPFDomain   string     `json:"spf_domain"` // Envelope sender domain (or HELO name) checked
+	DKIM        string     `json:"dkim"`
+	DKIMDomains StringList `json:"dkim_domains"` // Signing domains with a valid signature
+	DMARC       string     `json:"dmarc"`
+	DMARCPolicy string     `json:"dmarc_policy"` // Requested policy (p=) of the From domain
+	Results     string     `json:"results"`      // Authentication-Results header value
+}
+
+// How the mail reached the server: the client's connection and the SMTP transaction
+type Envelope struct {
+	Protocol         string     `json:"protocol"` // As in the Received header ("ESMTP", "ESMTPS", "ESMTPSA", "LMTP"...)
+	RemoteIP         string     `json:"remote_ip"`
+	Helo             string     `json:"helo"`        // HELO/EHLO name the client introduced itself with
+	TLSVersion       string     `json:"tls_version"` // Empty when received in plaintext
+	TLSCipher        string     `json:"tls_cipher"`
+	User             string     `json:"user"`               // Authenticated SMTP user, if any
+	Recipients       StringList `json:"recipients"`         // Every recipient of the transaction, To being the one this copy is for
+	Size             int        `json:"size"`               // Bytes received, trace header excluded
+	SessionStartedAt time.Time  `json:"session_started_at"` // When the client connected
+	ReceivedAt       time.Time  `json:"received_at"`        // When the whole message was received
+}
+
+type Attachment struct {
 	ID          string    `gorm:"type:varchar(36)" json:"id"`
-	Name        string    `json:"name"`
-	Address     string    `gorm:"unique" json:"address"`
-	Emails      []Mail    `gorm:"constraint:OnDelete:CASCADE;" json:"emails"`
-	Locked      bool      `json:"locked"`
-	UnreadCount uint      `json:"unread_count"`
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"content_type"`
+	Size        int       `json:"size"`
+	Checksum    string    `json:"checksum"` // SHA-256 of the contents, hex encoded
+	ContentID   string    `json:"content_id"`
+	Inline      bool      `json:"inline"` // Referenced from the HTML body rather than downloadable
+	Data        []byte    `json:"-"`
 	CreatedAt   time.Time `gorm:"autoCreateTime" json:"created_at"`
-	LastEmailAt time.Time `json:"last_email_at"`
-	ExpiresAt   time.Time `json:"expires_at"`
+	MailID      string    `gorm:"index" json:"-"`
 }
 
-type Mail struct {
-	ID        string    `gorm:"type:varchar(36)" json:"id"`
-	Subject   string    `json:"subject"`
-	From      string    `json:"from"`
-	To        string    `gorm:"index" json:"to"`
-	Body      string    `json:"body"`
-	Headers   string    `json:"headers"`
-	Read      bool      `json:"read"`
-	CreatedAt time.Time `gorm:"autoCreateTime" json:"created_at"`
-	MailBoxID string    `json:"-"`
+// Credentials allowing an SMTP client to submit mail for any recipient, which is captured
+// into the user's mailbox (or a capture mailbox made for them) instead of being relayed
+type SMTPUser struct {
+	ID           string    `gorm:"type:varchar(36)" json:"id"`
+	Username     string    `gorm:"unique" json:"username"`
+	PasswordHash []byte    `json:"-"`
+	MailBoxID    *string   `json:"mailbox_id"`
+	CreatedAt    time.Time `gorm:"autoCreateTime" json:"created_at"`
+}
+
+type MailHeader struct {
+	ID       uint   `gorm:"primaryKey" json:"-"`
+	Position int    `json:"-"`
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	RawValue string `json:"raw_value"`
+	MailID   string `gorm:"index" json:"-"`
+}
+
+// Usernames are a name ("ci") or an address ("ci@corp.test"), their capture mailbox being named after them
+func ValidateSMTPUsername(username string) error {
+	local_part, domain, has_domain := strings.Cut(username, "@")
+
+	if local_part == "" || strings.ContainsAny(username, " \t\r\n") || (has_domain && (domain == "" || strings.Contains(domain, "@"))) {
+		return errors.New("invalid username, use a name or an address")
+	}
+
+	return nil
 }
 
 func (mb *MailBox) BeforeCreate(tx *gorm.DB) (err error) {
@@ -45,6 +141,18 @@ func (mb *MailBox) BeforeCreate(tx *gorm.DB) (err error) {
 	return
 }
 
+func (u *SMTPUser) BeforeCreate(tx *gorm.DB) (err error) {
+	uuid, err := uuid.NewRandom()
+
+	if err != nil {
+		err = errors.New("couldn't  generate uuid")
+	}
+
+	u.ID = uuid.String()
+
+	return
+}
+
 func (m *Mail) BeforeCreate(tx *gorm.DB) (err error) {
 	uuid, err := uuid.NewRandom()
 
@@ -57,14 +165,40 @@ func (m *Mail) BeforeCreate(tx *gorm.DB) (err error) {
 	return
 }
 
+func (a *Attachment) BeforeCreate(tx *gorm.DB) (err error) {
+	uuid, err := uuid.NewRandom()
+
+	if err != nil {
+		err = errors.New("couldn't  generate uuid")
+	}
+
+	a.ID = uuid.String()
+
+	return
+}
+
+// Keeps the headers in the order they were received
+func HeaderOrder(db *gorm.DB) *gorm.DB {
+	return db.Order("position")
+}
+
+// Selects everything but the attachment contents, for listings
+func AttachmentMetadata(db *gorm.DB) *gorm.DB {
+	return db.Select("id", "filename", "content_type", "size", "checksum", "content_id", "inline", "created_at", "mail_id")
+}
+
 func Init() (*gorm.DB, error) {
-	db, err := gorm.Open(sqlite.Open("data.db"), &gorm.Config{})
+	// Foreign keys are enabled through the DSN so every pooled connection enforces the cascades
+	db, err := gorm.Open(sqlite.Open("data.db?_foreign_keys=on"), &gorm.Config{})
 
 	if err != nil {
 		return nil, err
 	}
 
-	db.AutoMigrate(&MailBox{}, &Mail{})
+	dropAddressUniqueness(db)
+
+	db.AutoMigrate(&Domain{}, &MailBox{}, &Mail{}, &Attachment{}, &MailHeader{}, &RawMessage{}, &SMTPUser{}, &FaultRule{}, &SenderRule{})
+	initSearchIndex(db)
 
 	return db, nil
 }
@@ -0,0 +1,149 @@
+package database
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/net/idna"
+	"golang.org/x/text/unicode/norm"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// A domain the server receives mail for
+type Domain struct {
+	ID        string    `gorm:"type:varchar(36)" json:"id"`
+	Name      string    `gorm:"unique" json:"name"`
+	CreatedAt time.Time `gorm:"autoCreateTime" json:"created_at"`
+}
+
+func (d *Domain) BeforeCreate(tx *gorm.DB) (err error) {
+	// Existing domains get "created" again when associated with a mailbox
+	if d.ID != "" {
+		return
+	}
+
+	uuid, err := uuid.NewRandom()
+
+	if err != nil {
+		err = errors.New("couldn't  generate uuid")
+	}
+
+	d.ID = uuid.String()
+
+	return
+}
+
+// Domain names are stored lowercase, without the trailing dot and in their Unicode form,
+// so "xn--fsqu00a.xn--0zwm56d" and "例子.测试" are the same domain
+func NormalizeDomain(name string) string {
+	name = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+
+	if unicode, err := idna.Lookup.ToUnicode(name); err == nil {
+		return unicode
+	}
+
+	// Names IDNA doesn't allow (underscores, wildcards...) still get their punycode labels decoded
+	if unicode, err := idna.Punycode.ToUnicode(name); err == nil {
+		name = unicode
+	}
+
+	return norm.NFC.String(name)
+}
+
+// Local parts are stored NFC normalized, so the same characters always are the same bytes
+func NormalizeLocalPart(local_part string) string {
+	return norm.NFC.String(local_part)
+}
+
+// Normalizes both parts of an address ("local@domain")
+func NormalizeAddress(address string) string {
+	idx := strings.LastIndex(address, "@")
+
+	if idx == -1 {
+		return NormalizeLocalPart(address)
+	}
+
+	return NormalizeLocalPart(address[:idx]) + "@" + NormalizeDomain(address[idx+1:])
+}
+
+func FindDomain(db *gorm.DB, name string) (*Domain, bool) {
+	var domain Domain
+
+	if q := db.Where("name = ?", NormalizeDomain(name)).Limit(1).Find(&domain); q.RowsAffected == 0 {
+		return nil, false
+	}
+
+	return &domain, true
+}
+
+// Creates the given domains if they don't exist yet
+func EnsureDomains(db *gorm.DB, names []string) error {
+	for _, name := range names {
+		if name = NormalizeDomain(name); name == "" {
+			continue
+		}
+
+		if q := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&Domain{Name: name}); q.Error != nil {
+			return q.Error
+		}
+	}
+
+	return nil
+}
+
+// Limits a mailbox query to the ones receiving mail for the domain,
+// mailboxes not bound to any domain receive mail for all of them
+func BoundToDomain(domain_id string) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where("NOT EXISTS (SELECT 1 FROM mail_box_domains WHERE mail_box_domains.mail_box_id = mail_boxes.id) OR "+
+			"EXISTS (SELECT 1 FROM mail_box_domains WHERE mail_box_domains.mail_box_id = mail_boxes.id AND mail_box_domains.domain_id = ?)", domain_id)
+	}
+}
+
+// Whether another mailbox with the address already receives mail for any of the domains,
+// mailboxes without domains receiving mail for all of them
+func AddressTaken(db *gorm.DB, address string, domains []Domain, except_id string) bool {
+	var others []MailBox
+
+	db.Preload("Domains").Where("address = ? AND id <> ? AND capture = ?", address, except_id, false).Find(&others)
+
+	for _, other := range others {
+		if len(domains) == 0 || len(other.Domains) == 0 {
+			return true
+		}
+
+		for _, domain := range domains {
+			for _, other_domain := range other.Domains {
+				if domain.ID == other_domain.ID {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// Gets the mailbox's full addresses, local part included. Capture mailboxes have none
+func (mb *MailBox) FullAddresses(all_domains []Domain) []string {
+	if mb.Capture {
+		return []string{}
+	}
+
+	domains := mb.Domains
+
+	if len(domains) == 0 {
+		domains = all_domains
+	}
+
+	addresses := make([]string, 0, len(domains))
+
+	for _, domain := range domains {
+		addresses = append(addresses, mb.Address+"@"+domain.Name)
+	}
+
+	return addresses
+}
@@ -0,0 +1,46 @@
+package database
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// SMTP transaction stages a fault can be injected at
+const (
+	FaultRcpt = "rcpt" // Reply to RCPT TO
+	FaultData = "data" // Reply to the message data, disconnecting drops the connection mid-DATA
+)
+
+// Makes the SMTP server misbehave for a mailbox's mail, to exercise senders' error handling
+type FaultRule struct {
+	ID         string    `gorm:"type:varchar(36)" json:"id"`
+	Stage      string    `json:"stage"`
+	Code       int       `json:"code"` // Reply code to fail with (421, 451, 550...), 0 to reply as usual
+	Message    string    `json:"message"`
+	DelayMs    int       `json:"delay_ms"`   // How long to wait before replying
+	Disconnect bool      `json:"disconnect"` // Drop the connection instead of replying
+	Nth        int       `json:"nth"`        // Only trigger on the Nth time the stage is reached, 0 for every time
+	Hits       int       `json:"hits"`       // How many times the stage was reached since the rule was created
+	CreatedAt  time.Time `gorm:"autoCreateTime" json:"created_at"`
+	MailBoxID  string    `gorm:"index" json:"mailbox_id"`
+}
+
+func (f *FaultRule) BeforeCreate(tx *gorm.DB) (err error) {
+	uuid, err := uuid.NewRandom()
+
+	if err != nil {
+		err = errors.New("couldn't  generate uuid")
+	}
+
+	f.ID = uuid.String()
+
+	return
+}
+
+// Keeps the fault rules in the order they were added, the first one triggering wins
+func FaultOrder(db *gorm.DB) *gorm.DB {
+	return db.Order("created_at")
+}
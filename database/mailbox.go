@@ -0,0 +1,93 @@
+package database
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// How a mailbox's address is matched against the recipient's local part
+const (
+	MatchExact = "exact"
+	MatchGlob  = "glob"  // "*" matches any characters and "?" a single one, "*" alone being a catch-all
+	MatchRegex = "regex" // Must match the whole local part
+)
+
+// What happens to mail sent to a locked mailbox
+const (
+	LockedDiscard = "discard" // Accepted, then dropped
+	LockedReject  = "reject"  // Refused at RCPT with a permanent error
+	LockedDefer   = "defer"   // Refused at RCPT with a temporary error, so the sender retries later
+)
+
+// Compiles the mailbox's address into a (case-insensitive) regular expression, for pattern mailboxes
+func (mb *MailBox) Pattern() (*regexp.Regexp, error) {
+	switch mb.MatchType {
+	case MatchGlob:
+		return globPattern(mb.Address)
+	case MatchRegex:
+		return regexp.Compile("(?i)^(?:" + mb.Address + ")$")
+	default:
+		return nil, errors.New("not a pattern mailbox")
+	}
+}
+
+// Compiles a glob ("*" matching any characters and "?" a single one) into a case-insensitive regular expression
+func globPattern(glob string) (*regexp.Regexp, error) {
+	pattern := regexp.QuoteMeta(glob)
+	pattern = strings.ReplaceAll(pattern, `\*`, ".*")
+	pattern = strings.ReplaceAll(pattern, `\?`, ".")
+
+	return regexp.Compile("(?i)^" + pattern + "$")
+}
+
+func FindExactMailBox(db *gorm.DB, local_part string, domain_id string) (*MailBox, bool) {
+	var mailbox MailBox
+
+	if q := db.Scopes(BoundToDomain(domain_id)).Where("address = ? AND match_type = ? AND capture = ?", local_part, MatchExact, false).Limit(1).Find(&mailbox); q.RowsAffected == 0 {
+		return nil, false
+	}
+
+	return &mailbox, true
+}
+
+// Finds the first pattern mailbox matching the local part, in this order:
+//   - globs with the most literal (non-wildcard) characters
+//   - regexes
+//   - catch-all globs (wildcards only)
+//
+// ties being broken by creation date, oldest first
+func FindPatternMailBox(db *gorm.DB, local_part string, domain_id string) (*MailBox, bool) {
+	var patterns []MailBox
+
+	db.Scopes(BoundToDomain(domain_id)).Where("match_type IN ? AND capture = ?", []string{MatchGlob, MatchRegex}, false).Order("created_at, id").Find(&patterns)
+
+	sort.SliceStable(patterns, func(i, j int) bool {
+		return patternRank(&patterns[i]) < patternRank(&patterns[j])
+	})
+
+	for i := range patterns {
+		if pattern, err := patterns[i].Pattern(); err == nil && pattern.MatchString(local_part) {
+			return &patterns[i], true
+		}
+	}
+
+	return nil, false
+}
+
+// Lower ranks take precedence
+func patternRank(mb *MailBox) int {
+	literals := len(strings.NewReplacer("*", "", "?", "").Replace(mb.Address))
+
+	switch {
+	case mb.MatchType == MatchGlob && literals > 0:
+		return -literals
+	case mb.MatchType == MatchRegex:
+		return 1
+	default:
+		return 2
+	}
+}
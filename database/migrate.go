@@ -0,0 +1,71 @@
+package database
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// Mailbox addresses used to be unique across all domains
+func dropAddressUniqueness(db *gorm.DB) {
+	rebuildTable(db, "mail_boxes", "`address` text UNIQUE", "`address` text")
+}
+
+// Changes a table's definition, which SQLite only allows by copying it into a new table.
+// Does nothing if the table doesn't have the old definition. Foreign keys are off meanwhile
+// so that dropping the old table doesn't cascade to the rows referencing it
+func rebuildTable(db *gorm.DB, table string, old_definition string, new_definition string) {
+	var table_sql string
+
+	db.Raw("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&table_sql)
+
+	if !strings.Contains(table_sql, old_definition) {
+		return
+	}
+
+	sql_db, err := db.DB()
+
+	if err != nil {
+		return
+	}
+
+	ctx := context.Background()
+	conn, err := sql_db.Conn(ctx)
+
+	if err != nil {
+		return
+	}
+
+	defer conn.Close()
+
+	conn.ExecContext(ctx, "PRAGMA foreign_keys = OFF")
+	defer conn.ExecContext(ctx, "PRAGMA foreign_keys = ON")
+
+	tx, err := conn.BeginTx(ctx, nil)
+
+	if err != nil {
+		return
+	}
+
+	temp_table := table + "__temp"
+	new_sql := strings.Replace(strings.Replace(table_sql, old_definition, new_definition, 1), "`"+table+"`", "`"+temp_table+"`", 1)
+
+	statements := []string{
+		new_sql,
+		"INSERT INTO " + temp_table + " SELECT * FROM " + table,
+		"DROP TABLE " + table,
+		"ALTER TABLE " + temp_table + " RENAME TO " + table,
+	}
+
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			log.Println("Error migrating the "+table+" table:", err)
+			tx.Rollback()
+			return
+		}
+	}
+
+	tx.Commit()
+}
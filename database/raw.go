@@ -0,0 +1,69 @@
+package database
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// The original message as received, gzipped and addressed by the SHA-256 of its contents
+// so copies of the same message are only stored once
+type RawMessage struct {
+	ID        string    `gorm:"type:varchar(64)"`
+	Data      []byte    // gzipped
+	Size      int       // uncompressed
+	CreatedAt time.Time `gorm:"autoCreateTime"`
+}
+
+// Saves a raw message (if it isn't stored already), returning its ID
+func StoreRawMessage(db *gorm.DB, data []byte) (string, error) {
+	hash := sha256.Sum256(data)
+	id := hex.EncodeToString(hash[:])
+
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+
+	if _, err := writer.Write(data); err != nil {
+		return "", err
+	}
+
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+
+	model := RawMessage{ID: id, Data: compressed.Bytes(), Size: len(data)}
+
+	// A message stored again is as recent as a new one, for the cleaner's grace period
+	on_conflict := clause.OnConflict{Columns: []clause.Column{{Name: "id"}}, DoUpdates: clause.Assignments(map[string]interface{}{"created_at": time.Now()})}
+
+	if q := db.Clauses(on_conflict).Create(&model); q.Error != nil {
+		return "", q.Error
+	}
+
+	return id, nil
+}
+
+// Gets a raw message's original bytes
+func LoadRawMessage(db *gorm.DB, id string) ([]byte, error) {
+	var model RawMessage
+
+	if q := db.Where("id = ?", id).Limit(1).Find(&model); q.Error != nil {
+		return nil, q.Error
+	} else if q.RowsAffected == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(model.Data))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return io.ReadAll(reader)
+}
@@ -0,0 +1,232 @@
+package database
+
+import (
+	"database/sql"
+	"log"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// Whether mails are indexed for full-text search, which needs SQLite's FTS5 extension
+// (built in with the sqlite_fts5 build tag). Searches fall back to LIKE scans without it
+var FullTextSearch bool
+
+// Indexed columns by search prefix, a term without a prefix matches any of them
+var search_fields = map[string]string{
+	"from":       "sender",     // Envelope sender and From header
+	"to":         "recipients", // Envelope recipient, To and Cc headers
+	"subject":    "subject",
+	"body":       "body", // Text version of the body
+	"attachment": "attachments",
+}
+
+// Escapes LIKE wildcards, for the fallback search
+var like_escaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// A word or "quoted phrase" to look for, in a single field if it had a prefix ("from:alice")
+type SearchTerm struct {
+	Field string
+	Text  string
+}
+
+// Creates the index mails are searched with. Its rows are numbered in mails_fts_ids, which maps
+// them to their mail's ID (mails' own rowids may be renumbered by a VACUUM), so that deletions
+// (including the cascades from mailboxes) can be applied by a trigger with indexed lookups
+func initSearchIndex(db *gorm.DB) {
+	var exists, synced int64
+
+	db.Raw("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'mails_fts'").Scan(&exists)
+	db.Raw("SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND name = 'mails_fts_delete'").Scan(&synced)
+
+	var err error
+
+	if exists == 0 {
+		err = db.Exec("CREATE VIRTUAL TABLE mails_fts USING fts5(subject, sender, recipients, body, attachments, tokenize = 'unicode61 remove_diacritics 2')").Error
+	} else {
+		err = db.Exec("SELECT rowid FROM mails_fts LIMIT 0").Error
+	}
+
+	if err != nil {
+		log.Println("Full-text search unavailable, build with the sqlite_fts5 tag to enable it:", err)
+
+		// Deleting mails would fail, and the index is rebuilt once it's available again
+		db.Exec("DROP TRIGGER IF EXISTS mails_fts_delete")
+
+		return
+	}
+
+	if err := db.Exec("CREATE TABLE IF NOT EXISTS mails_fts_ids (rowid INTEGER PRIMARY KEY, mail_id TEXT NOT NULL UNIQUE)").Error; err != nil {
+		log.Println("Error creating the search index:", err)
+		return
+	}
+
+	err = db.Exec(`CREATE TRIGGER IF NOT EXISTS mails_fts_delete AFTER DELETE ON mails BEGIN
+		DELETE FROM mails_fts WHERE rowid = (SELECT rowid FROM mails_fts_ids WHERE mail_id = old.id);
+		DELETE FROM mails_fts_ids WHERE mail_id = old.id;
+	END`).Error
+
+	if err != nil {
+		log.Println("Error creating the search index trigger:", err)
+		return
+	}
+
+	FullTextSearch = true
+
+	// Index the mails received before the index existed or while it wasn't available
+	if synced == 0 {
+		var mails []Mail
+
+		db.Exec("DELETE FROM mails_fts")
+		db.Exec("DELETE FROM mails_fts_ids")
+
+		db.Preload("Attachments", AttachmentMetadata).FindInBatches(&mails, 100, func(tx *gorm.DB, batch int) error {
+			for i := range mails {
+				mails[i].index(db)
+			}
+
+			return nil
+		})
+	}
+}
+
+// Called once the mail and its attachments are saved
+func (m *Mail) AfterCreate(tx *gorm.DB) (err error) {
+	if FullTextSearch {
+		m.index(tx)
+	}
+
+	return
+}
+
+// Adds the mail to the search index, failing to do so doesn't fail the delivery
+func (m *Mail) index(tx *gorm.DB) {
+	sender := []string{m.From}
+	recipients := []string{m.To}
+	attachments := make([]string, 0, len(m.Attachments))
+
+	for _, address := range m.HeaderFrom {
+		sender = append(sender, address.Name, address.Address)
+	}
+
+	for _, address := range append(m.HeaderTo, m.HeaderCc...) {
+		recipients = append(recipients, address.Name, address.Address)
+	}
+
+	for _, attachment := range m.Attachments {
+		attachments = append(attachments, attachment.Filename)
+	}
+
+	// New statements each time, the hook's one still holding the mail's insertion
+	fresh := tx.Session(&gorm.Session{NewDB: true})
+
+	err := fresh.Exec("INSERT INTO mails_fts_ids (mail_id) VALUES (?)", m.ID).Error
+
+	if err == nil {
+		err = fresh.Exec("INSERT INTO mails_fts (rowid, subject, sender, recipients, body, attachments) SELECT rowid, ?, ?, ?, ?, ? FROM mails_fts_ids WHERE mail_id = ?",
+			m.Subject, strings.Join(sender, " "), strings.Join(recipients, " "), m.TextBody, strings.Join(attachments, " "), m.ID).Error
+	}
+
+	if err != nil {
+		log.Println("Error indexing mail "+m.ID+":", err)
+	}
+}
+
+// Splits a search query into its terms: words, "quoted phrases" and prefixed ones
+// ("from:alice", "subject:"weekly report""). Unknown prefixes are searched as is
+func ParseSearchQuery(query string) []SearchTerm {
+	var terms []SearchTerm
+
+	for query = strings.TrimSpace(query); query != ""; query = strings.TrimSpace(query) {
+		var term SearchTerm
+
+		if idx := strings.IndexAny(query, ": \""); idx > 0 && query[idx] == ':' {
+			if _, ok := search_fields[strings.ToLower(query[:idx])]; ok {
+				term.Field, query = strings.ToLower(query[:idx]), query[idx+1:]
+			}
+		}
+
+		if strings.HasPrefix(query, "\"") {
+			end := strings.Index(query[1:], "\"")
+
+			if end == -1 {
+				term.Text, query = query[1:], ""
+			} else {
+				term.Text, query = query[1:end+1], query[end+2:]
+			}
+		} else if end := strings.IndexAny(query, " \t"); end == -1 {
+			term.Text, query = query, ""
+		} else {
+			term.Text, query = query[:end], query[end:]
+		}
+
+		if term.Text = strings.TrimSpace(term.Text); term.Text != "" {
+			terms = append(terms, term)
+		}
+	}
+
+	return terms
+}
+
+// Limits a mail query to the ones matching every term, terms matching the beginning of words
+func MatchingSearch(terms []SearchTerm) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		if len(terms) == 0 {
+			return db
+		}
+
+		if FullTextSearch {
+			return db.Where("mails.id IN (SELECT mails_fts_ids.mail_id FROM mails_fts JOIN mails_fts_ids ON mails_fts_ids.rowid = mails_fts.rowid WHERE mails_fts MATCH ?)", ftsQuery(terms))
+		}
+
+		for _, term := range terms {
+			db = db.Where(likeCondition(term.Field), sql.Named("text", like_escaper.Replace(term.Text)))
+		}
+
+		return db
+	}
+}
+
+// Builds the FTS5 query matching every term, each being quoted so its text isn't taken as query syntax
+func ftsQuery(terms []SearchTerm) string {
+	parts := make([]string, 0, len(terms))
+
+	for _, term := range terms {
+		part := "\"" + strings.ReplaceAll(term.Text, "\"", "\"\"") + "\"*"
+
+		if term.Field != "" {
+			part = search_fields[term.Field] + " : " + part
+		}
+
+		parts = append(parts, part)
+	}
+
+	return strings.Join(parts, " AND ")
+}
+
+// Condition for the fallback search, a case-insensitive substring match on the field(s)
+func likeCondition(field string) string {
+	columns := map[string][]string{
+		"sender":      {"mails.\"from\"", "mails.header_from"},
+		"recipients":  {"mails.\"to\"", "mails.header_to", "mails.header_cc"},
+		"subject":     {"mails.subject"},
+		"body":        {"mails.text_body"},
+		"attachments": {"(SELECT group_concat(filename, ' ') FROM attachments WHERE attachments.mail_id = mails.id)"},
+	}
+
+	var searched []string
+
+	if field != "" {
+		searched = columns[search_fields[field]]
+	} else {
+		for _, name := range []string{"sender", "recipients", "subject", "body", "attachments"} {
+			searched = append(searched, columns[name]...)
+		}
+	}
+
+	for i, column := range searched {
+		searched[i] = "COALESCE(" + column + ", '') LIKE '%' || @text || '%' ESCAPE '\\'"
+	}
+
+	return "(" + strings.Join(searched, " OR ") + ")"
+}
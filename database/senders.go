@@ -0,0 +1,92 @@
+package database
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// What a sender rule does to the senders it matches
+const (
+	SenderAllow = "allow" // Once a mailbox has allow rules (its own or global ones), only matching senders get through
+	SenderDeny  = "deny"  // Always wins over allow rules
+)
+
+// Allows or denies senders mail for a mailbox, or for all of them when it has none
+type SenderRule struct {
+	ID        string    `gorm:"type:varchar(36)" json:"id"`
+	Action    string    `json:"action"`
+	Pattern   string    `json:"pattern"` // Address ("a@b.c"), domain ("b.c" or "@b.c"), wildcards ("*@*.b.c") or the client's IP/CIDR range ("10.0.0.0/8")
+	CreatedAt time.Time `gorm:"autoCreateTime" json:"created_at"`
+	MailBoxID *string   `gorm:"index" json:"mailbox_id"`
+}
+
+func (r *SenderRule) BeforeCreate(tx *gorm.DB) (err error) {
+	uuid, err := uuid.NewRandom()
+
+	if err != nil {
+		err = errors.New("couldn't  generate uuid")
+	}
+
+	r.ID = uuid.String()
+
+	return
+}
+
+// Whether the rule's pattern is an IP address or CIDR range, matched against the client rather than the sender
+func (r *SenderRule) IsNetwork() bool {
+	return strings.Contains(r.Pattern, "/") || net.ParseIP(r.Pattern) != nil
+}
+
+// Parses the rule's IP address or CIDR range
+func (r *SenderRule) Network() (*net.IPNet, error) {
+	if ip := net.ParseIP(r.Pattern); ip != nil {
+		bits := 128
+
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, network, err := net.ParseCIDR(r.Pattern)
+
+	return network, err
+}
+
+// Whether the rule applies to the envelope sender or the client's IP (which may be unknown)
+func (r *SenderRule) Matches(sender string, ip net.IP) bool {
+	if r.IsNetwork() {
+		network, err := r.Network()
+
+		return err == nil && ip != nil && network.Contains(ip)
+	}
+
+	pattern := strings.TrimPrefix(r.Pattern, "@")
+	subject := sender
+
+	// Domain rules are matched against the sender's domain only
+	if !strings.Contains(pattern, "@") {
+		if idx := strings.LastIndex(sender, "@"); idx != -1 {
+			subject = sender[idx+1:]
+		} else {
+			subject = ""
+		}
+	}
+
+	matcher, err := globPattern(pattern)
+
+	return err == nil && subject != "" && matcher.MatchString(subject)
+}
+
+// Global rules plus the mailbox's own
+func SenderRulesFor(mailbox_id string) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where("mail_box_id IS NULL OR mail_box_id = ?", mailbox_id)
+	}
+}
@@ -0,0 +1,65 @@
+package database
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+)
+
+type Address struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+}
+
+// A list of addresses, stored as JSON
+type AddressList []Address
+
+func (l AddressList) Value() (driver.Value, error) {
+	return marshalColumn(l)
+}
+
+func (l *AddressList) Scan(value interface{}) error {
+	return unmarshalColumn(value, l)
+}
+
+func (AddressList) GormDataType() string {
+	return "text"
+}
+
+// A list of strings, stored as JSON
+type StringList []string
+
+func (l StringList) Value() (driver.Value, error) {
+	return marshalColumn(l)
+}
+
+func (l *StringList) Scan(value interface{}) error {
+	return unmarshalColumn(value, l)
+}
+
+func (StringList) GormDataType() string {
+	return "text"
+}
+
+func marshalColumn(value interface{}) (driver.Value, error) {
+	data, err := json.Marshal(value)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return string(data), nil
+}
+
+func unmarshalColumn(value interface{}, target interface{}) error {
+	switch data := value.(type) {
+	case nil:
+		return nil
+	case string:
+		return json.Unmarshal([]byte(data), target)
+	case []byte:
+		return json.Unmarshal(data, target)
+	default:
+		return errors.New("unsupported column type")
+	}
+}
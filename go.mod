@@ -3,12 +3,16 @@ module gotemp
 go 1.18
 
 require (
+	github.com/emersion/go-msgauth v0.6.6
 	github.com/emersion/go-smtp v0.15.1-0.20211103212524-30169acc42e7
 	github.com/golang-jwt/jwt v3.2.2+incompatible
 	github.com/google/uuid v1.3.0
 	github.com/joho/godotenv v1.4.0
 	github.com/labstack/echo/v4 v4.7.2
-	golang.org/x/crypto v0.0.0-20220331220935-ae2d96664a29
+	github.com/pires/go-proxyproto v0.6.2
+	golang.org/x/crypto v0.0.0-20220518034528-6f7dac969898
+	golang.org/x/net v0.0.0-20220403103023-749bd193bc2b
+	golang.org/x/text v0.3.7
 	gorm.io/driver/sqlite v1.2.6
 	gorm.io/gorm v1.22.4
 	nhooyr.io/websocket v1.8.7
@@ -26,8 +30,6 @@ require (
 	github.com/mattn/go-sqlite3 v1.14.10 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
 	github.com/valyala/fasttemplate v1.2.1 // indirect
-	golang.org/x/net v0.0.0-20220403103023-749bd193bc2b // indirect
 	golang.org/x/sys v0.0.0-20220405052023-b1e9470b6e64 // indirect
-	golang.org/x/text v0.3.7 // indirect
 	golang.org/x/time v0.0.0-20220224211638-0e9765cccd65 // indirect
 )
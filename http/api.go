@@ -1,10 +1,12 @@
 package http
 
 import (
+	"errors"
 	"gotemp/database"
 	"io"
 	"net/http"
 	"os"
+	"strings"
 
 	"github.com/golang-jwt/jwt"
 	"github.com/labstack/echo/v4"
@@ -18,31 +20,57 @@ type API struct {
 }
 
 type MailBoxForm struct {
-	Name       string `json:"name" form:"name" binding:"required,min=1,max=64"`
-	Address    string `json:"address" form:"address" binding:"required,min=1,max=64,excludes=@"`
-	Locked     bool   `json:"locked" form:"locked"`
-	Expiration string `json:"expires_at" form:"expires_at"`
+	Name           string   `json:"name" form:"name" binding:"required,min=1,max=64"`
+	Address        string   `json:"address" form:"address" binding:"required,min=1,max=64,excludes=@"`
+	MatchType      string   `json:"match_type" form:"match_type"`
+	Domains        []string `json:"domains" form:"domains"` // Domain names, none meaning all of them
+	Locked         bool     `json:"locked" form:"locked"`
+	LockedBehavior string   `json:"locked_behavior" form:"locked_behavior"`
+	Expiration     string   `json:"expires_at" form:"expires_at"`
+
+	MaxMessageBytes *int `json:"max_message_bytes" form:"max_message_bytes"` // 0 means the server's limit
 }
 
 func initAPI(e *echo.Echo, db *gorm.DB) {
-	api := API{Database: db, ServerName: GetEnv("SMTP_DOMAIN", "gotemp")}
+	api := API{Database: db, ServerName: strings.Split(GetEnv("SMTP_DOMAIN", "gotemp"), ",")[0]}
 
 	e.POST("api/login", api.Login)
 	e.GET("api/status", api.GetStatus)
 	e.PUT("api/key", api.SetKey)
+	e.GET("api/mailboxes/:id/:mailid/attachments/:attachmentid", api.DownloadAttachment, AttachmentAuthMiddleware())
 
 	g := e.Group("/api")
 	{
 		e.Use(CorsMiddleware())
 		g.Use(AuthMiddleware())
 
+		g.GET("/domains", api.GetDomains)
+		g.POST("/domains", api.CreateDomain)
+		g.DELETE("/domains/:id", api.DeleteDomain)
+		g.GET("/rate-limits", api.GetRateLimits)
+		g.GET("/sender-rules", api.GetGlobalSenderRules)
+		g.POST("/sender-rules", api.CreateGlobalSenderRule)
+		g.DELETE("/sender-rules/:id", api.DeleteGlobalSenderRule)
+		g.GET("/smtp-users", api.GetSMTPUsers)
+		g.POST("/smtp-users", api.CreateSMTPUser)
+		g.DELETE("/smtp-users/:id", api.DeleteSMTPUser)
+		g.GET("/mails", api.FindEmails)
+		g.GET("/search", api.Search)
 		g.GET("/mailboxes", api.GetAll)
 		g.GET("/mailboxes/:id", api.GetOne)
 		g.PUT("/mailboxes/:id", api.EditOne)
 		g.POST("/mailboxes", api.Create)
 		g.DELETE("/mailboxes/:id", api.Delete)
 		g.DELETE("/mailboxes/:id/mails", api.DeleteEmails)
+		g.GET("/mailboxes/:id/faults", api.GetFaultRules)
+		g.POST("/mailboxes/:id/faults", api.CreateFaultRule)
+		g.DELETE("/mailboxes/:id/faults/:faultid", api.DeleteFaultRule)
+		g.GET("/mailboxes/:id/senders", api.GetSenderRules)
+		g.POST("/mailboxes/:id/senders", api.CreateSenderRule)
+		g.DELETE("/mailboxes/:id/senders/:ruleid", api.DeleteSenderRule)
 		g.PUT("/mailboxes/:id/:mailid/read", api.MarkEmailRead)
+		g.GET("/mailboxes/:id/:mailid/raw", api.GetRawEmail)
+		g.GET("/mailboxes/:id/:mailid/attachments", api.GetAttachments)
 	}
 }
 
@@ -69,13 +97,13 @@ func (api *API) Login(c echo.Context) error {
 }
 
 // GET /status: checks whether the client is authorized to make further queries
-// {success: bool}
+// {success: bool, server_name: string, unconfigured: bool, full_text_search: bool}
 func (api *API) GetStatus(c echo.Context) error {
 	if len(secret_key) != 0 && !validateJwtFromRequest(c) {
 		return c.JSON(http.StatusUnauthorized, echo.Map{"success": false, "error": "Unauthorized"})
 	}
 
-	return c.JSON(200, echo.Map{"success": true, "server_name": api.ServerName, "unconfigured": len(secret_key) == 0})
+	return c.JSON(200, echo.Map{"success": true, "server_name": api.ServerName, "unconfigured": len(secret_key) == 0, "full_text_search": database.FullTextSearch})
 }
 
 // PUT /key: sets the server's secret key
@@ -114,22 +142,101 @@ func (api *API) SetKey(c echo.Context) error {
 func (api *API) GetAll(c echo.Context) error {
 	var mailboxes []database.MailBox
 
-	api.Database.Order("last_email_at desc").Find(&mailboxes)
+	api.Database.Preload("Domains").Preload("FaultRules", database.FaultOrder).Preload("SenderRules").Order("last_email_at desc").Find(&mailboxes)
+
+	for i := range mailboxes {
+		api.fillAddresses(&mailboxes[i])
+	}
 
 	return c.JSON(200, echo.Map{"success": true, "mailboxes": mailboxes})
 }
 
+// GET /mails: finds emails across all mailboxes
+// ?mailbox=id: only emails in this mailbox
+// ?tag=tag: only emails sent to this sub-address
+// ?header=Name: only emails having this header, ?header=Name:value only the ones where it equals value (can be repeated)
+// ?limit=n: maximum number of emails to return (default 50, up to 500)
+// {success: bool, mails: []Mail}
+func (api *API) FindEmails(c echo.Context) error {
+	query := api.Database.Model(&database.Mail{})
+
+	if mailbox_id := c.QueryParam("mailbox"); mailbox_id != "" {
+		query = query.Where("mail_box_id = ?", mailbox_id)
+	}
+
+	if tag := c.QueryParam("tag"); tag != "" {
+		query = query.Where("tag = ?", tag)
+	}
+
+	for _, filter := range c.QueryParams()["header"] {
+		name, value, has_value := strings.Cut(filter, ":")
+		name = strings.TrimSpace(name)
+
+		if name == "" {
+			return c.JSON(400, echo.Map{"success": false, "error": "Invalid header filter, use 'Name' or 'Name:value'"})
+		}
+
+		// Header names are case-insensitive
+		if has_value {
+			query = query.Where("EXISTS (SELECT 1 FROM mail_headers WHERE mail_headers.mail_id = mails.id AND mail_headers.name = ? COLLATE NOCASE AND mail_headers.value = ?)", name, strings.TrimSpace(value))
+		} else {
+			query = query.Where("EXISTS (SELECT 1 FROM mail_headers WHERE mail_headers.mail_id = mails.id AND mail_headers.name = ? COLLATE NOCASE)", name)
+		}
+	}
+
+	limit, err := parseLimit(c.QueryParam("limit"), 50, 500)
+
+	if err != nil {
+		return c.JSON(400, echo.Map{"success": false, "error": err.Error()})
+	}
+
+	mails := []database.Mail{}
+
+	query.Preload("Attachments", database.AttachmentMetadata).Preload("HeaderFields", database.HeaderOrder).Order("created_at desc").Limit(limit).Find(&mails)
+
+	for i := range mails {
+		RewriteInlineImages(mails[i].MailBoxID, &mails[i])
+	}
+
+	return c.JSON(200, echo.Map{"success": true, "mails": mails})
+}
+
 // GET /mailboxes/:id: gets an specific mailbox contents (including emails)
+// ?body=html|text: which version of the emails goes in their "body" field (defaults to HTML when available)
+// ?tag=tag: only the emails sent to this sub-address
 // {success: bool, mailbox: MailBox}
 func (api *API) GetOne(c echo.Context) error {
 	var mailbox database.MailBox
 
+	body_type := c.QueryParam("body")
+
+	if body_type != "" && body_type != "html" && body_type != "text" {
+		return c.JSON(400, echo.Map{"success": false, "error": "Invalid body type, use 'html' or 'text'"})
+	}
+
 	sortEmails := func(db *gorm.DB) *gorm.DB { return db.Order("created_at desc") }
 
-	if q := api.Database.Where("id = ?", c.Param("id")).Preload("Emails", sortEmails).Limit(1).Find(&mailbox); q.RowsAffected == 0 {
+	if tag := c.QueryParam("tag"); tag != "" {
+		sortEmails = func(db *gorm.DB) *gorm.DB { return db.Where("tag = ?", tag).Order("created_at desc") }
+	}
+
+	if q := api.Database.Where("id = ?", c.Param("id")).Preload("Domains").Preload("FaultRules", database.FaultOrder).Preload("SenderRules").Preload("Emails", sortEmails).Preload("Emails.Attachments", database.AttachmentMetadata).Preload("Emails.HeaderFields", database.HeaderOrder).Limit(1).Find(&mailbox); q.RowsAffected == 0 {
 		return c.JSON(400, echo.Map{"success": false, "error": "Invalid mailbox"})
 	}
 
+	api.fillAddresses(&mailbox)
+
+	for i := range mailbox.Emails {
+		RewriteInlineImages(mailbox.ID, &mailbox.Emails[i])
+
+		switch body_type {
+		case "html":
+			mailbox.Emails[i].Body = mailbox.Emails[i].HTMLBody
+		case "text":
+			mailbox.Emails[i].Body = mailbox.Emails[i].TextBody
+		}
+	}
+
 	return c.JSON(200, echo.Map{"success": true, "mailbox": mailbox})
 }
 
@@ -145,15 +252,57 @@ func (api *API) EditOne(c echo.Context) error {
 	// Check if the email exists
 	var mailbox database.MailBox
 
-	if q := api.Database.Where("id = ?", c.Param("id")).Limit(1).Find(&mailbox); q.RowsAffected == 0 {
+	if q := api.Database.Where("id = ?", c.Param("id")).Preload("Domains").Limit(1).Find(&mailbox); q.RowsAffected == 0 {
 		return c.JSON(400, echo.Map{"success": false, "error": "Invalid mailbox"})
 	}
 
 	// Update its properties
 	mailbox.Name = input.Name
-	mailbox.Address = input.Address
 	mailbox.Locked = input.Locked
 
+	if !mailbox.Capture {
+		mailbox.Address = input.Address
+	}
+
+	// Clients unaware of patterns don't send the match type, keep it as is
+	if input.MatchType != "" {
+		mailbox.MatchType = input.MatchType
+	}
+
+	if input.LockedBehavior != "" {
+		mailbox.LockedBehavior = input.LockedBehavior
+	}
+
+	// Clients unaware of size limits don't send them, keep it as is
+	if input.MaxMessageBytes != nil {
+		mailbox.MaxMessageBytes = *input.MaxMessageBytes
+	}
+
+	if err := validateMailBoxAddress(&mailbox); err != nil {
+		return c.JSON(400, echo.Map{"success": false, "error": err.Error()})
+	}
+
+	if err := validateLockedBehavior(&mailbox); err != nil {
+		return c.JSON(400, echo.Map{"success": false, "error": err.Error()})
+	}
+
+	if mailbox.MaxMessageBytes < 0 {
+		return c.JSON(400, echo.Map{"success": false, "error": "Invalid size limit"})
+	}
+
+	// Clients unaware of domains don't send them, keep them as they are
+	domains := mailbox.Domains
+
+	if input.Domains != nil {
+		found, ok := api.findDomains(input.Domains)
+
+		if !ok {
+			return c.JSON(400, echo.Map{"success": false, "error": "Invalid domain"})
+		}
+
+		domains = found
+	}
+
 	// Try to parse expiration time (if set)
 	time, err := parseExpiration(input.Expiration)
 
@@ -163,8 +312,25 @@ func (api *API) EditOne(c echo.Context) error {
 
 	mailbox.ExpiresAt = time
 
-	// Save model
-	api.Database.Save(&mailbox)
+	if database.AddressTaken(api.Database, mailbox.Address, domains, mailbox.ID) {
+		return c.JSON(400, echo.Map{"success": false, "error": "A Mailbox with this address already exists on these domains!"})
+	}
+
+	// Save model, along with its domains
+	err = api.Database.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&mailbox).Association("Domains").Replace(domains); err != nil {
+			return err
+		}
+
+		return tx.Omit("Domains").Save(&mailbox).Error
+	})
+
+	if err != nil {
+		return c.JSON(500, echo.Map{"success": false, "error": err.Error()})
+	}
+
+	api.Database.Model(&mailbox).Association("Domains").Find(&mailbox.Domains)
+	api.fillAddresses(&mailbox)
 
 	SendSocketMessage("MAILBOX_EDITED", mailbox)
 	return c.JSON(200, echo.Map{"success": true, "id": c.Param("id")})
@@ -180,11 +346,37 @@ func (api *API) Create(c echo.Context) error {
 	}
 
 	model := database.MailBox{
-		Name:    data.Name,
-		Address: data.Address,
-		Locked:  data.Locked,
+		Name:           data.Name,
+		Address:        data.Address,
+		MatchType:      data.MatchType,
+		Locked:         data.Locked,
+		LockedBehavior: data.LockedBehavior,
+	}
+
+	if data.MaxMessageBytes != nil {
+		model.MaxMessageBytes = *data.MaxMessageBytes
+	}
+
+	if err := validateMailBoxAddress(&model); err != nil {
+		return c.JSON(400, echo.Map{"success": false, "error": err.Error()})
 	}
 
+	if err := validateLockedBehavior(&model); err != nil {
+		return c.JSON(400, echo.Map{"success": false, "error": err.Error()})
+	}
+
+	if model.MaxMessageBytes < 0 {
+		return c.JSON(400, echo.Map{"success": false, "error": "Invalid size limit"})
+	}
+
+	domains, ok := api.findDomains(data.Domains)
+
+	if !ok {
+		return c.JSON(400, echo.Map{"success": false, "error": "Invalid domain"})
+	}
+
+	model.Domains = domains
+
 	// Try to parse expiration time (if set)
 	time, err := parseExpiration(data.Expiration)
 
@@ -194,15 +386,17 @@ func (api *API) Create(c echo.Context) error {
 
 	model.ExpiresAt = time
 
-	// Make sure a mailbox with the choosen address doesn't exists already
-	if q := api.Database.Where("address = ?", data.Address).Limit(1).Find(&database.MailBox{}); q.RowsAffected != 0 {
-		return c.JSON(400, echo.Map{"success": false, "error": "A Mailbox with this address already exists!"})
+	// Make sure no mailbox with the choosen address receives mail for its domains already
+	if database.AddressTaken(api.Database, model.Address, model.Domains, "") {
+		return c.JSON(400, echo.Map{"success": false, "error": "A Mailbox with this address already exists on these domains!"})
 	}
 
 	if q := api.Database.Create(&model); q.RowsAffected == 0 {
 		return c.JSON(500, echo.Map{"success": false, "error": q.Error.Error()})
 	}
 
+	api.fillAddresses(&model)
+
 	SendSocketMessage("MAILBOX_CREATED", model)
 	return c.JSON(200, echo.Map{"success": true, "id": model.ID})
 }
@@ -258,3 +452,60 @@ func (api *API) MarkEmailRead(c echo.Context) error {
 
 	return c.JSON(200, echo.Map{"success": true, "id": c.Param("mailid")})
 }
+
+// GET /mailboxes/:id/:mailid/raw - downloads the email exactly as it was received
+// message/rfc822 contents
+func (api *API) GetRawEmail(c echo.Context) error {
+	var mail database.Mail
+
+	if q := api.Database.Where("id = ? AND mail_box_id = ?", c.Param("mailid"), c.Param("id")).Limit(1).Find(&mail); q.RowsAffected == 0 {
+		return c.JSON(400, echo.Map{"success": false, "error": "Invalid email and/or mailbox"})
+	}
+
+	// Mails received before raw messages were kept don't have one
+	data, err := database.LoadRawMessage(api.Database, mail.RawMessageID)
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return c.JSON(404, echo.Map{"success": false, "error": "Raw message not available for this email"})
+	} else if err != nil {
+		return c.JSON(500, echo.Map{"success": false, "error": err.Error()})
+	}
+
+	return sendFile(c, mail.ID+".eml", "message/rfc822", data)
+}
+
+// GET /mailboxes/:id/:mailid/attachments - lists an email's attachments
+// {success: bool, attachments: []Attachment}
+func (api *API) GetAttachments(c echo.Context) error {
+	if !api.mailExists(c.Param("id"), c.Param("mailid")) {
+		return c.JSON(400, echo.Map{"success": false, "error": "Invalid email and/or mailbox"})
+	}
+
+	attachments := []database.Attachment{}
+
+	api.Database.Scopes(database.AttachmentMetadata).Where("mail_id = ?", c.Param("mailid")).Find(&attachments)
+
+	return c.JSON(200, echo.Map{"success": true, "attachments": attachments})
+}
+
+// GET /mailboxes/:id/:mailid/attachments/:attachmentid - downloads an attachment
+// raw attachment contents
+func (api *API) DownloadAttachment(c echo.Context) error {
+	if !api.mailExists(c.Param("id"), c.Param("mailid")) {
+		return c.JSON(400, echo.Map{"success": false, "error": "Invalid email and/or mailbox"})
+	}
+
+	var attachment database.Attachment
+
+	if q := api.Database.Where("id = ? AND mail_id = ?", c.Param("attachmentid"), c.Param("mailid")).Limit(1).Find(&attachment); q.RowsAffected == 0 {
+		return c.JSON(400, echo.Map{"success": false, "error": "Invalid attachment"})
+	}
+
+	return sendFile(c, attachment.Filename, attachment.ContentType, attachment.Data)
+}
+
+func (api *API) mailExists(mailbox_id string, mail_id string) bool {
+	q := api.Database.Where("id = ? AND mail_box_id = ?", mail_id, mailbox_id).Limit(1).Find(&database.Mail{})
+
+	return q.RowsAffected != 0
+}
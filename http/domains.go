@@ -0,0 +1,96 @@
+package http
+
+import (
+	"strings"
+
+	"gotemp/database"
+
+	"github.com/labstack/echo/v4"
+)
+
+type DomainForm struct {
+	Name string `json:"name" form:"name"`
+}
+
+// GET /domains: returns all the domains mail is received for
+// {success: bool, domains: []Domain}
+func (api *API) GetDomains(c echo.Context) error {
+	domains := []database.Domain{}
+
+	api.Database.Order("name").Find(&domains)
+
+	return c.JSON(200, echo.Map{"success": true, "domains": domains})
+}
+
+// POST /domains: adds a domain
+// {success: bool, id: string}
+func (api *API) CreateDomain(c echo.Context) error {
+	var input DomainForm
+
+	if e := c.Bind(&input); e != nil {
+		return c.JSON(400, echo.Map{"success": false, "error": e.Error()})
+	}
+
+	model := database.Domain{Name: database.NormalizeDomain(input.Name)}
+
+	if model.Name == "" || strings.ContainsAny(model.Name, "@ \t/") {
+		return c.JSON(400, echo.Map{"success": false, "error": "Invalid domain name"})
+	}
+
+	if _, exists := database.FindDomain(api.Database, model.Name); exists {
+		return c.JSON(400, echo.Map{"success": false, "error": "This domain already exists!"})
+	}
+
+	if q := api.Database.Create(&model); q.RowsAffected == 0 {
+		return c.JSON(500, echo.Map{"success": false, "error": q.Error.Error()})
+	}
+
+	return c.JSON(200, echo.Map{"success": true, "id": model.ID})
+}
+
+// DELETE /domains/:id: removes a domain, as long as no mailbox is bound to it
+// {success: bool, id: string}
+func (api *API) DeleteDomain(c echo.Context) error {
+	var bound int64
+
+	api.Database.Table("mail_box_domains").Where("domain_id = ?", c.Param("id")).Count(&bound)
+
+	// Mailboxes left without domains would start receiving mail for all of them
+	if bound != 0 {
+		return c.JSON(400, echo.Map{"success": false, "error": "This domain is still used by some mailboxes"})
+	}
+
+	if q := api.Database.Where("id = ?", c.Param("id")).Delete(&database.Domain{}); q.RowsAffected == 0 {
+		return c.JSON(400, echo.Map{"success": false, "error": "Invalid domain"})
+	}
+
+	return c.JSON(200, echo.Map{"success": true, "id": c.Param("id")})
+}
+
+// Gets the domains with the given names, failing if any of them doesn't exist
+func (api *API) findDomains(names []string) ([]database.Domain, bool) {
+	domains := []database.Domain{}
+
+	for _, name := range names {
+		domain, ok := database.FindDomain(api.Database, name)
+
+		if !ok {
+			return nil, false
+		}
+
+		domains = append(domains, *domain)
+	}
+
+	return domains, true
+}
+
+// Fills in the mailboxes' full addresses, their domains must be preloaded
+func (api *API) fillAddresses(mailboxes ...*database.MailBox) {
+	var domains []database.Domain
+
+	api.Database.Order("name").Find(&domains)
+
+	for _, mailbox := range mailboxes {
+		mailbox.Addresses = mailbox.FullAddresses(domains)
+	}
+}
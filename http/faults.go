@@ -0,0 +1,95 @@
+package http
+
+import (
+	"gotemp/database"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Longest delay a fault rule may cause, clients usually give up after 5 minutes
+const max_fault_delay_ms = 5 * 60 * 1000
+
+type FaultRuleForm struct {
+	Stage      string `json:"stage" form:"stage"` // "rcpt" or "data"
+	Code       int    `json:"code" form:"code"`
+	Message    string `json:"message" form:"message"`
+	DelayMs    int    `json:"delay_ms" form:"delay_ms"`
+	Disconnect bool   `json:"disconnect" form:"disconnect"`
+	Nth        int    `json:"nth" form:"nth"`
+}
+
+// GET /mailboxes/:id/faults: returns the mailbox's fault injection rules
+// {success: bool, faults: []FaultRule}
+func (api *API) GetFaultRules(c echo.Context) error {
+	if q := api.Database.Where("id = ?", c.Param("id")).Limit(1).Find(&database.MailBox{}); q.RowsAffected == 0 {
+		return c.JSON(400, echo.Map{"success": false, "error": "Invalid mailbox"})
+	}
+
+	rules := []database.FaultRule{}
+
+	api.Database.Scopes(database.FaultOrder).Where("mail_box_id = ?", c.Param("id")).Find(&rules)
+
+	return c.JSON(200, echo.Map{"success": true, "faults": rules})
+}
+
+// POST /mailboxes/:id/faults: adds a rule making the SMTP server misbehave for the mailbox
+// {success: bool, id: string}
+func (api *API) CreateFaultRule(c echo.Context) error {
+	var input FaultRuleForm
+
+	if e := c.Bind(&input); e != nil {
+		return c.JSON(400, echo.Map{"success": false, "error": e.Error()})
+	}
+
+	if input.Stage != database.FaultRcpt && input.Stage != database.FaultData {
+		return c.JSON(400, echo.Map{"success": false, "error": "Invalid stage, use 'rcpt' or 'data'"})
+	}
+
+	if input.Code != 0 && (input.Code < 400 || input.Code > 599) {
+		return c.JSON(400, echo.Map{"success": false, "error": "Invalid code, it must be a 4xx or 5xx reply code"})
+	}
+
+	if input.DelayMs < 0 || input.DelayMs > max_fault_delay_ms {
+		return c.JSON(400, echo.Map{"success": false, "error": "Invalid delay"})
+	}
+
+	if input.Nth < 0 {
+		return c.JSON(400, echo.Map{"success": false, "error": "Invalid nth"})
+	}
+
+	if input.Code == 0 && input.DelayMs == 0 && !input.Disconnect {
+		return c.JSON(400, echo.Map{"success": false, "error": "A fault rule needs a code, a delay or to disconnect"})
+	}
+
+	var mailbox database.MailBox
+
+	if q := api.Database.Where("id = ?", c.Param("id")).Limit(1).Find(&mailbox); q.RowsAffected == 0 {
+		return c.JSON(400, echo.Map{"success": false, "error": "Invalid mailbox"})
+	}
+
+	model := database.FaultRule{
+		Stage:      input.Stage,
+		Code:       input.Code,
+		Message:    input.Message,
+		DelayMs:    input.DelayMs,
+		Disconnect: input.Disconnect,
+		Nth:        input.Nth,
+		MailBoxID:  mailbox.ID,
+	}
+
+	if q := api.Database.Create(&model); q.RowsAffected == 0 {
+		return c.JSON(500, echo.Map{"success": false, "error": q.Error.Error()})
+	}
+
+	return c.JSON(200, echo.Map{"success": true, "id": model.ID})
+}
+
+// DELETE /mailboxes/:id/faults/:faultid: deletes a fault injection rule
+// {success: bool, id: string}
+func (api *API) DeleteFaultRule(c echo.Context) error {
+	if q := api.Database.Where("id = ? AND mail_box_id = ?", c.Param("faultid"), c.Param("id")).Delete(&database.FaultRule{}); q.RowsAffected == 0 {
+		return c.JSON(400, echo.Map{"success": false, "error": "Invalid fault rule"})
+	}
+
+	return c.JSON(200, echo.Map{"success": true, "id": c.Param("faultid")})
+}
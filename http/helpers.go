@@ -1,14 +1,32 @@
 package http
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"gotemp/database"
+	"mime"
+	"net"
+	"net/url"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt"
 	"github.com/labstack/echo/v4"
 )
 
+// How long the signed URLs of inline images stay valid
+const signed_url_lifetime = 24 * time.Hour
+
+// A whole cid: reference, up to the quote, space or parenthesis ending it
+var cid_regex = regexp.MustCompile(`(?i)cid:[^"'\s()<>]+`)
+
 func parseExpiration(expiration string) (time.Time, error) {
 	if expiration != "" {
 		if expiration == "never" {
@@ -34,6 +52,119 @@ func parseExpiration(expiration string) (time.Time, error) {
 	}
 }
 
+// Parses a "limit" query param, falling back to a default when absent
+func parseLimit(value string, fallback int, max int) (int, error) {
+	if value == "" {
+		return fallback, nil
+	}
+
+	limit, err := strconv.Atoi(value)
+
+	if err != nil || limit < 1 || limit > max {
+		return 0, fmt.Errorf("invalid limit, use a number between 1 and %d", max)
+	}
+
+	return limit, nil
+}
+
+// Makes sure the mailbox's address is valid for its match type (exact by default)
+func validateMailBoxAddress(mailbox *database.MailBox) error {
+	// Named after their SMTP user, and never matched against recipients
+	if mailbox.Capture {
+		return nil
+	}
+
+	if mailbox.MatchType == "" {
+		mailbox.MatchType = database.MatchExact
+	}
+
+	if mailbox.Address == "" {
+		return errors.New("an address is required")
+	}
+
+	mailbox.Address = database.NormalizeLocalPart(mailbox.Address)
+
+	switch mailbox.MatchType {
+	case database.MatchExact, database.MatchGlob:
+		if strings.Contains(mailbox.Address, "@") {
+			return errors.New("the address must not contain a domain")
+		}
+
+		if mailbox.MatchType == database.MatchExact {
+			return nil
+		}
+	case database.MatchRegex:
+	default:
+		return errors.New("invalid match type, use 'exact', 'glob' or 'regex'")
+	}
+
+	if _, err := mailbox.Pattern(); err != nil {
+		return fmt.Errorf("invalid address pattern: %s", err.Error())
+	}
+
+	return nil
+}
+
+func validateLockedBehavior(mailbox *database.MailBox) error {
+	switch mailbox.LockedBehavior {
+	case "":
+		mailbox.LockedBehavior = database.LockedDiscard
+	case database.LockedDiscard, database.LockedReject, database.LockedDefer:
+	default:
+		return errors.New("invalid locked behavior, use 'discard', 'reject' or 'defer'")
+	}
+
+	return nil
+}
+
+func validateSenderRule(rule *database.SenderRule) error {
+	rule.Pattern = strings.ToLower(strings.TrimSpace(rule.Pattern))
+
+	if rule.Action != database.SenderAllow && rule.Action != database.SenderDeny {
+		return errors.New("invalid action, use 'allow' or 'deny'")
+	}
+
+	if rule.Pattern == "" || strings.ContainsAny(rule.Pattern, " \t<>") {
+		return errors.New("invalid pattern")
+	}
+
+	if rule.IsNetwork() {
+		if _, err := rule.Network(); err != nil {
+			return errors.New("invalid IP range")
+		}
+
+		return nil
+	}
+
+	if strings.Count(rule.Pattern, "@") > 1 {
+		return errors.New("invalid pattern, use an address, a domain or an IP range")
+	}
+
+	// Matched against normalized senders
+	if strings.Contains(rule.Pattern, "@") {
+		rule.Pattern = database.NormalizeAddress(rule.Pattern)
+	} else {
+		rule.Pattern = database.NormalizeDomain(rule.Pattern)
+	}
+
+	return nil
+}
+
+// Takes client IPs from X-Forwarded-For only when it's set by a trusted proxy
+func ipExtractor(trusted_proxies []*net.IPNet) echo.IPExtractor {
+	if len(trusted_proxies) == 0 {
+		return echo.ExtractIPDirect()
+	}
+
+	options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+
+	for _, network := range trusted_proxies {
+		options = append(options, echo.TrustIPRange(network))
+	}
+
+	return echo.ExtractIPFromXFFHeader(options...)
+}
+
 func validateJwt(attempt_token string) bool {
 	token, err := jwt.Parse(attempt_token, func(t *jwt.Token) (interface{}, error) {
 		return secret_key, nil
@@ -47,16 +178,89 @@ func validateJwt(attempt_token string) bool {
 }
 
 func validateJwtFromRequest(c echo.Context) bool {
+	token := getRequestToken(c)
+
+	if token == "" {
+		return false
+	}
+
+	// Make sure the token is valid
+	return validateJwt(token)
+}
+
+func getRequestToken(c echo.Context) string {
 	header := c.Request().Header.Get("Authorization")
 
 	// Valid tokens are in the following format:
 	// bearer secretkeyhere
-	if header == "" || header[6:7] != " " {
+	if len(header) > 7 && header[6:7] == " " {
+		return header[7:]
+	}
+
+	return ""
+}
+
+// Signs an attachment's download path, resources fetched by the browser itself (like inline
+// images) can't send the token so their URL carries a signature only valid for that attachment
+func signAttachmentPath(mailbox_id string, mail_id string, attachment_id string) string {
+	path := fmt.Sprintf("/api/mailboxes/%s/%s/attachments/%s", mailbox_id, mail_id, attachment_id)
+	expires := strconv.FormatInt(time.Now().Add(signed_url_lifetime).Unix(), 10)
+
+	return path + "?expires=" + expires + "&signature=" + attachmentSignature(path, expires)
+}
+
+func attachmentSignature(path string, expires string) string {
+	mac := hmac.New(sha256.New, secret_key)
+	mac.Write([]byte(path + "?expires=" + expires))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Whether the request carries a valid, unexpired signature for its path
+func validateAttachmentSignature(c echo.Context) bool {
+	expires, signature := c.QueryParam("expires"), c.QueryParam("signature")
+	expires_at, err := strconv.ParseInt(expires, 10, 64)
+
+	if err != nil || len(secret_key) == 0 || time.Now().Unix() > expires_at {
 		return false
 	}
 
-	// Make sure the token is valid
-	return validateJwt(header[7:])
+	return hmac.Equal([]byte(signature), []byte(attachmentSignature(c.Request().URL.Path, expires)))
+}
+
+// Points the email's cid: references (RFC 2392) at the matching attachments' signed download path
+func RewriteInlineImages(mailbox_id string, mail *database.Mail) {
+	paths := make(map[string]string)
+
+	for _, attachment := range mail.Attachments {
+		if attachment.ContentID != "" {
+			paths[attachment.ContentID] = signAttachmentPath(mailbox_id, mail.ID, attachment.ID)
+		}
+	}
+
+	if len(paths) == 0 {
+		return
+	}
+
+	replace := func(reference string) string {
+		cid := reference[len("cid:"):]
+
+		// cid URLs are supposed to be %-encoded, but not everyone does it
+		if path, ok := paths[cid]; ok {
+			return path
+		}
+
+		if unescaped, err := url.PathUnescape(cid); err == nil {
+			if path, ok := paths[unescaped]; ok {
+				return path
+			}
+		}
+
+		return reference
+	}
+
+	mail.HTMLBody = cid_regex.ReplaceAllStringFunc(mail.HTMLBody, replace)
+	mail.Body = cid_regex.ReplaceAllStringFunc(mail.Body, replace)
 }
 
 func isDirectory(path string) bool {
@@ -68,3 +272,15 @@ func isDirectory(path string) bool {
 
 	return true
 }
+
+// Streams a file to the client as a download
+func sendFile(c echo.Context, filename string, content_type string, data []byte) error {
+	header := c.Response().Header()
+
+	header.Set(echo.HeaderContentDisposition, mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	header.Set(echo.HeaderContentLength, strconv.Itoa(len(data)))
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set("Content-Security-Policy", "default-src 'none'; sandbox")
+
+	return c.Stream(200, content_type, bytes.NewReader(data))
+}
@@ -2,6 +2,9 @@ package http
 
 import (
 	"log"
+	"net"
+
+	"gotemp/proxy"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
@@ -27,6 +30,25 @@ func Init(db *gorm.DB, key []byte) {
 	e.HidePort = true
 	e.Use(CorsMiddleware())
 
+	trusted_proxies, err := proxy.ParseNetworks(GetEnv("TRUSTED_PROXIES", ""))
+
+	if err != nil {
+		log.Fatalln("Invalid TRUSTED_PROXIES:", err)
+	}
+
+	e.IPExtractor = ipExtractor(trusted_proxies)
+
+	// Clients connecting through a trusted proxy are identified by the PROXY protocol header it sends
+	if GetEnv("HTTP_PROXY_PROTOCOL", "false") == "true" && len(trusted_proxies) > 0 {
+		listener, err := net.Listen("tcp", GetEnv("HTTP_ADDRESS", ":2527"))
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		e.Listener = proxy.NewListener(listener, trusted_proxies)
+	}
+
 	initAPI(e, db)
 
 	e.GET("/socket", socketHandler)
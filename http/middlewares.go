@@ -20,6 +20,19 @@ func AuthMiddleware() echo.MiddlewareFunc {
 	}
 }
 
+// Lets attachments be downloaded with a token or through the signed path inline images point at
+func AttachmentAuthMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if !validateJwtFromRequest(c) && !validateAttachmentSignature(c) {
+				return c.JSON(http.StatusUnauthorized, echo.Map{"success": false, "error": "Unauthorized"})
+			}
+
+			return next(c)
+		}
+	}
+}
+
 func CorsMiddleware() echo.MiddlewareFunc {
 	allow_origins := GetEnv("CORS_ALLOWED_ORIGINS", "")
 	allow_methods := GetEnv("CORS_ALLOWED_METHODS", "GET, POST, PATCH, PUT, DELETE, OPTIONS")
@@ -0,0 +1,17 @@
+package http
+
+import (
+	"gotemp/ratelimit"
+
+	"github.com/labstack/echo/v4"
+)
+
+// GET /rate-limits: returns the SMTP rate limits and the counters of the client IPs and mailboxes seen lately
+// {success: bool, ip: {limits: Limits, counters: []Stats}, mailbox: {limits: Limits, counters: []Stats}}
+func (api *API) GetRateLimits(c echo.Context) error {
+	return c.JSON(200, echo.Map{
+		"success": true,
+		"ip":      echo.Map{"limits": ratelimit.IPs.Limits(), "counters": ratelimit.IPs.Stats()},
+		"mailbox": echo.Map{"limits": ratelimit.MailBoxes.Limits(), "counters": ratelimit.MailBoxes.Stats()},
+	})
+}
@@ -0,0 +1,96 @@
+package http
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"gotemp/database"
+
+	"github.com/labstack/echo/v4"
+)
+
+// GET /search: full-text search across mails, newest first
+// ?q=query: words (or "quoted phrases") the mails must all contain, matching the beginning of words.
+// "from:", "to:", "subject:", "body:" and "attachment:" prefixes look for a word in that field only
+// ?mailbox=id: only mails in this mailbox
+// ?since=date&until=date: only mails received in this range (RFC-3339 or YYYY-MM-DD, until being inclusive)
+// ?read=true|false: only read or unread mails
+// ?limit=n: maximum number of mails to return (default 50, up to 500)
+// {success: bool, mails: []Mail, full_text: bool}
+func (api *API) Search(c echo.Context) error {
+	query := api.Database.Model(&database.Mail{}).Scopes(database.MatchingSearch(database.ParseSearchQuery(c.QueryParam("q"))))
+
+	if mailbox_id := c.QueryParam("mailbox"); mailbox_id != "" {
+		query = query.Where("mail_box_id = ?", mailbox_id)
+	}
+
+	if since := c.QueryParam("since"); since != "" {
+		since_time, err := parseSearchDate(since, false)
+
+		if err != nil {
+			return c.JSON(400, echo.Map{"success": false, "error": err.Error()})
+		}
+
+		query = query.Where("created_at >= ?", since_time)
+	}
+
+	if until := c.QueryParam("until"); until != "" {
+		until_time, err := parseSearchDate(until, true)
+
+		if err != nil {
+			return c.JSON(400, echo.Map{"success": false, "error": err.Error()})
+		}
+
+		query = query.Where("created_at < ?", until_time)
+	}
+
+	switch c.QueryParam("read") {
+	case "":
+	case "true":
+		query = query.Where("read = ?", true)
+	case "false":
+		query = query.Where("read = ?", false)
+	default:
+		return c.JSON(400, echo.Map{"success": false, "error": "Invalid read filter, use 'true' or 'false'"})
+	}
+
+	limit, err := parseLimit(c.QueryParam("limit"), 50, 500)
+
+	if err != nil {
+		return c.JSON(400, echo.Map{"success": false, "error": err.Error()})
+	}
+
+	mails := []database.Mail{}
+
+	if q := query.Preload("Attachments", database.AttachmentMetadata).Preload("HeaderFields", database.HeaderOrder).Order("created_at desc").Limit(limit).Find(&mails); q.Error != nil {
+		log.Println("Error searching mails:", q.Error)
+		return c.JSON(500, echo.Map{"success": false, "error": q.Error.Error()})
+	}
+
+	for i := range mails {
+		RewriteInlineImages(mails[i].MailBoxID, &mails[i])
+	}
+
+	return c.JSON(200, echo.Map{"success": true, "mails": mails, "full_text": database.FullTextSearch})
+}
+
+// Parses a search date, a day alone meaning its start (or its end, for the end of a range)
+func parseSearchDate(value string, end_of_range bool) (time.Time, error) {
+	// Compared with the stored dates, which are in the server's time zone
+	if parsed_time, err := time.Parse(time.RFC3339, value); err == nil {
+		return parsed_time.Local(), nil
+	}
+
+	day, err := time.ParseInLocation("2006-01-02", value, time.Local)
+
+	if err != nil {
+		return time.Time{}, errors.New("invalid date, use the RFC-3339 or YYYY-MM-DD format")
+	}
+
+	if end_of_range {
+		day = day.AddDate(0, 0, 1)
+	}
+
+	return day, nil
+}
@@ -0,0 +1,94 @@
+package http
+
+import (
+	"gotemp/database"
+
+	"github.com/labstack/echo/v4"
+)
+
+type SenderRuleForm struct {
+	Action  string `json:"action" form:"action"` // "allow" or "deny"
+	Pattern string `json:"pattern" form:"pattern"`
+}
+
+// GET /sender-rules: returns the sender rules applying to all mailboxes
+// {success: bool, rules: []SenderRule}
+func (api *API) GetGlobalSenderRules(c echo.Context) error {
+	rules := []database.SenderRule{}
+
+	api.Database.Where("mail_box_id IS NULL").Order("created_at").Find(&rules)
+
+	return c.JSON(200, echo.Map{"success": true, "rules": rules})
+}
+
+// POST /sender-rules: adds a sender rule applying to all mailboxes
+// {success: bool, id: string}
+func (api *API) CreateGlobalSenderRule(c echo.Context) error {
+	return api.createSenderRule(c, nil)
+}
+
+// DELETE /sender-rules/:id: deletes a sender rule applying to all mailboxes
+// {success: bool, id: string}
+func (api *API) DeleteGlobalSenderRule(c echo.Context) error {
+	if q := api.Database.Where("id = ? AND mail_box_id IS NULL", c.Param("id")).Delete(&database.SenderRule{}); q.RowsAffected == 0 {
+		return c.JSON(400, echo.Map{"success": false, "error": "Invalid sender rule"})
+	}
+
+	return c.JSON(200, echo.Map{"success": true, "id": c.Param("id")})
+}
+
+// GET /mailboxes/:id/senders: returns the mailbox's own sender rules
+// {success: bool, rules: []SenderRule}
+func (api *API) GetSenderRules(c echo.Context) error {
+	if q := api.Database.Where("id = ?", c.Param("id")).Limit(1).Find(&database.MailBox{}); q.RowsAffected == 0 {
+		return c.JSON(400, echo.Map{"success": false, "error": "Invalid mailbox"})
+	}
+
+	rules := []database.SenderRule{}
+
+	api.Database.Where("mail_box_id = ?", c.Param("id")).Order("created_at").Find(&rules)
+
+	return c.JSON(200, echo.Map{"success": true, "rules": rules})
+}
+
+// POST /mailboxes/:id/senders: adds a sender rule to the mailbox
+// {success: bool, id: string}
+func (api *API) CreateSenderRule(c echo.Context) error {
+	var mailbox database.MailBox
+
+	if q := api.Database.Where("id = ?", c.Param("id")).Limit(1).Find(&mailbox); q.RowsAffected == 0 {
+		return c.JSON(400, echo.Map{"success": false, "error": "Invalid mailbox"})
+	}
+
+	return api.createSenderRule(c, &mailbox.ID)
+}
+
+// DELETE /mailboxes/:id/senders/:ruleid: deletes one of the mailbox's sender rules
+// {success: bool, id: string}
+func (api *API) DeleteSenderRule(c echo.Context) error {
+	if q := api.Database.Where("id = ? AND mail_box_id = ?", c.Param("ruleid"), c.Param("id")).Delete(&database.SenderRule{}); q.RowsAffected == 0 {
+		return c.JSON(400, echo.Map{"success": false, "error": "Invalid sender rule"})
+	}
+
+	return c.JSON(200, echo.Map{"success": true, "id": c.Param("ruleid")})
+}
+
+func (api *API) createSenderRule(c echo.Context, mailbox_id *string) error {
+	var input SenderRuleForm
+
+	if e := c.Bind(&input); e != nil {
+		return c.JSON(400, echo.Map{"success": false, "error": e.Error()})
+	}
+
+	model := database.SenderRule{Action: input.Action, Pattern: input.Pattern, MailBoxID: mailbox_id}
+
+	if err := validateSenderRule(&model); err != nil {
+		return c.JSON(400, echo.Map{"success": false, "error": err.Error()})
+	}
+
+	if q := api.Database.Create(&model); q.RowsAffected == 0 {
+		return c.JSON(500, echo.Map{"success": false, "error": q.Error.Error()})
+	}
+
+	return c.JSON(200, echo.Map{"success": true, "id": model.ID})
+}
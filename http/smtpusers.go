@@ -0,0 +1,80 @@
+package http
+
+import (
+	"gotemp/database"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type SMTPUserForm struct {
+	Username  string  `json:"username" form:"username"`
+	Password  string  `json:"password" form:"password"`
+	MailBoxID *string `json:"mailbox_id" form:"mailbox_id"` // Where mail is captured, a capture mailbox made on first use when empty
+}
+
+// GET /smtp-users: returns all SMTP users
+// {success: bool, users: []SMTPUser}
+func (api *API) GetSMTPUsers(c echo.Context) error {
+	users := []database.SMTPUser{}
+
+	api.Database.Order("username").Find(&users)
+
+	return c.JSON(200, echo.Map{"success": true, "users": users})
+}
+
+// POST /smtp-users: creates an SMTP user allowed to submit mail
+// {success: bool, id: string}
+func (api *API) CreateSMTPUser(c echo.Context) error {
+	var input SMTPUserForm
+
+	if e := c.Bind(&input); e != nil {
+		return c.JSON(400, echo.Map{"success": false, "error": e.Error()})
+	}
+
+	if input.Username == "" || input.Password == "" {
+		return c.JSON(400, echo.Map{"success": false, "error": "A username and a password are required"})
+	}
+
+	if err := database.ValidateSMTPUsername(input.Username); err != nil {
+		return c.JSON(400, echo.Map{"success": false, "error": err.Error()})
+	}
+
+	if input.MailBoxID != nil && *input.MailBoxID == "" {
+		input.MailBoxID = nil
+	}
+
+	if input.MailBoxID != nil {
+		if q := api.Database.Where("id = ?", *input.MailBoxID).Limit(1).Find(&database.MailBox{}); q.RowsAffected == 0 {
+			return c.JSON(400, echo.Map{"success": false, "error": "Invalid mailbox"})
+		}
+	}
+
+	if q := api.Database.Where("username = ?", input.Username).Limit(1).Find(&database.SMTPUser{}); q.RowsAffected != 0 {
+		return c.JSON(400, echo.Map{"success": false, "error": "An SMTP user with this username already exists!"})
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(input.Password), bcrypt.DefaultCost)
+
+	if err != nil {
+		return c.JSON(500, echo.Map{"success": false, "error": ""})
+	}
+
+	model := database.SMTPUser{Username: input.Username, PasswordHash: hash, MailBoxID: input.MailBoxID}
+
+	if q := api.Database.Create(&model); q.RowsAffected == 0 {
+		return c.JSON(500, echo.Map{"success": false, "error": q.Error.Error()})
+	}
+
+	return c.JSON(200, echo.Map{"success": true, "id": model.ID})
+}
+
+// DELETE /smtp-users/:id: deletes an SMTP user
+// {success: bool, id: string}
+func (api *API) DeleteSMTPUser(c echo.Context) error {
+	if q := api.Database.Where("id = ?", c.Param("id")).Delete(&database.SMTPUser{}); q.RowsAffected == 0 {
+		return c.JSON(400, echo.Map{"success": false, "error": "Invalid SMTP user"})
+	}
+
+	return c.JSON(200, echo.Map{"success": true, "id": c.Param("id")})
+}
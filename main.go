@@ -46,7 +46,6 @@ func main() {
 		log.Fatalln("Error connecting to the database", err.Error())
 	}
 
-	db_.Exec("PRAGMA foreign_keys = ON")
 	db = db_
 
 	// Init SMTP server
@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pires/go-proxyproto"
+)
+
+// How long a trusted proxy gets to send the PROXY header once connected
+const header_timeout = 5 * time.Second
+
+var errListenerClosed = errors.New("listener closed")
+
+// Parses a comma separated list of IP addresses and CIDR ranges
+func ParseNetworks(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+
+		if item == "" {
+			continue
+		}
+
+		if ip := net.ParseIP(item); ip != nil {
+			bits := 128
+
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(item)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP range %q", item)
+		}
+
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+func IsTrusted(networks []*net.IPNet, addr net.Addr) bool {
+	tcp_addr, ok := addr.(*net.TCPAddr)
+
+	if !ok {
+		return false
+	}
+
+	for _, network := range networks {
+		if network.Contains(tcp_addr.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Reads the PROXY protocol (v1 or v2) header connections from trusted proxies must start with,
+// so that their remote address is the client's. Other connections are left untouched, a header
+// they'd send is then just invalid data. Headers are read off the accept loop so a slow proxy
+// doesn't hold up the other connections
+type Listener struct {
+	net.Listener
+	trusted []*net.IPNet
+	conns   chan net.Conn
+	err     chan error
+	done    chan struct{}
+}
+
+func NewListener(listener net.Listener, trusted []*net.IPNet) *Listener {
+	l := &Listener{
+		Listener: listener,
+		trusted:  trusted,
+		conns:    make(chan net.Conn),
+		err:      make(chan error, 1),
+		done:     make(chan struct{}),
+	}
+
+	go l.acceptLoop()
+
+	return l
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.err:
+		return nil, err
+	case <-l.done:
+		return nil, errListenerClosed
+	}
+}
+
+func (l *Listener) Close() error {
+	select {
+	case <-l.done:
+	default:
+		close(l.done)
+	}
+
+	return l.Listener.Close()
+}
+
+func (l *Listener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+
+		if err != nil {
+			var net_err net.Error
+
+			// Temporary errors are retried by the server, so wait for its next Accept
+			if errors.As(err, &net_err) && net_err.Temporary() {
+				select {
+				case l.err <- err:
+					continue
+				case <-l.done:
+					return
+				}
+			}
+
+			l.err <- err
+			return
+		}
+
+		if !IsTrusted(l.trusted, conn.RemoteAddr()) {
+			l.deliver(conn)
+			continue
+		}
+
+		go l.readHeader(conn)
+	}
+}
+
+func (l *Listener) readHeader(conn net.Conn) {
+	proxy_conn := proxyproto.NewConn(conn, proxyproto.WithPolicy(proxyproto.REQUIRE))
+
+	conn.SetReadDeadline(time.Now().Add(header_timeout))
+	header := proxy_conn.ProxyHeader()
+	conn.SetReadDeadline(time.Time{})
+
+	if header == nil {
+		log.Println("Missing or invalid PROXY protocol header from", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+
+	l.deliver(proxy_conn)
+}
+
+func (l *Listener) deliver(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
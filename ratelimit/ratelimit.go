@@ -0,0 +1,189 @@
+package ratelimit
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// The window messages are counted in
+const window = time.Minute
+
+// How long counters of a key are kept once it's idle
+const retention = time.Hour
+
+// Limits how many messages per minute and concurrent sessions each key (client IP, mailbox...) gets
+type Limiter struct {
+	mu                  sync.Mutex
+	messages_per_minute int // 0 means unlimited
+	concurrent_sessions int // 0 means unlimited
+	entries             map[string]*entry
+	last_pruned         time.Time
+}
+
+type entry struct {
+	messages       []time.Time // Within the window, oldest first
+	sessions       int
+	throttled      uint64
+	last_seen      time.Time
+	last_throttled time.Time
+}
+
+// A key's counters, as shown to admins
+type Stats struct {
+	Key                string    `json:"key"`
+	Sessions           int       `json:"sessions"`
+	MessagesLastMinute int       `json:"messages_last_minute"`
+	Throttled          uint64    `json:"throttled"` // Messages and sessions refused
+	LastSeenAt         time.Time `json:"last_seen_at"`
+	LastThrottledAt    time.Time `json:"last_throttled_at"`
+}
+
+// The limits of a Limiter
+type Limits struct {
+	MessagesPerMinute  int `json:"messages_per_minute"`
+	ConcurrentSessions int `json:"concurrent_sessions"`
+}
+
+var (
+	IPs       = New() // By client IP
+	MailBoxes = New() // By mailbox ID
+)
+
+// Makes a limiter without limits, which still keeps the counters
+func New() *Limiter {
+	return &Limiter{entries: make(map[string]*entry)}
+}
+
+func (l *Limiter) SetLimits(messages_per_minute int, concurrent_sessions int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.messages_per_minute = messages_per_minute
+	l.concurrent_sessions = concurrent_sessions
+}
+
+func (l *Limiter) Limits() Limits {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return Limits{MessagesPerMinute: l.messages_per_minute, ConcurrentSessions: l.concurrent_sessions}
+}
+
+// Counts a message, returns false (and counts nothing) if the key already sent too many in the last minute
+func (l *Limiter) AllowMessage(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	e := l.entry(key, now)
+
+	if l.messages_per_minute > 0 && len(e.messages) >= l.messages_per_minute {
+		e.throttle(now)
+		return false
+	}
+
+	e.messages = append(e.messages, now)
+
+	return true
+}
+
+// Starts a session, returns false if the key already has too many. Sessions started must be ended
+func (l *Limiter) StartSession(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	e := l.entry(key, now)
+
+	if l.concurrent_sessions > 0 && e.sessions >= l.concurrent_sessions {
+		e.throttle(now)
+		return false
+	}
+
+	e.sessions++
+
+	return true
+}
+
+func (l *Limiter) EndSession(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if e, ok := l.entries[key]; ok && e.sessions > 0 {
+		e.sessions--
+	}
+}
+
+// Gets the counters of every key seen lately, most recently seen first
+func (l *Limiter) Stats() []Stats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	stats := []Stats{}
+
+	l.prune(now)
+
+	for key, e := range l.entries {
+		e.expire(now)
+
+		stats = append(stats, Stats{
+			Key:                key,
+			Sessions:           e.sessions,
+			MessagesLastMinute: len(e.messages),
+			Throttled:          e.throttled,
+			LastSeenAt:         e.last_seen,
+			LastThrottledAt:    e.last_throttled,
+		})
+	}
+
+	sort.Slice(stats, func(i, j int) bool { return stats[i].LastSeenAt.After(stats[j].LastSeenAt) })
+
+	return stats
+}
+
+func (l *Limiter) entry(key string, now time.Time) *entry {
+	e, ok := l.entries[key]
+
+	if !ok {
+		if now.Sub(l.last_pruned) > window {
+			l.prune(now)
+		}
+
+		e = &entry{}
+		l.entries[key] = e
+	}
+
+	e.last_seen = now
+	e.expire(now)
+
+	return e
+}
+
+// Forgets the keys idle for too long
+func (l *Limiter) prune(now time.Time) {
+	l.last_pruned = now
+
+	for key, e := range l.entries {
+		if e.sessions == 0 && now.Sub(e.last_seen) > retention {
+			delete(l.entries, key)
+		}
+	}
+}
+
+// Forgets the messages out of the window
+func (e *entry) expire(now time.Time) {
+	i := 0
+
+	for i < len(e.messages) && now.Sub(e.messages[i]) >= window {
+		i++
+	}
+
+	e.messages = e.messages[i:]
+}
+
+func (e *entry) throttle(now time.Time) {
+	e.throttled++
+	e.last_throttled = now
+}
@@ -0,0 +1,93 @@
+package smtp
+
+import (
+	"mime"
+	"net/mail"
+	"regexp"
+	"strings"
+
+	"gotemp/database"
+
+	"golang.org/x/net/idna"
+)
+
+var (
+	address_parser   = mail.AddressParser{WordDecoder: &mime.WordDecoder{CharsetReader: charsetReader}}
+	message_id_regex = regexp.MustCompile(`<([^<>\s]+)>`)
+	email_regex      = regexp.MustCompile(`[^\s<>,;:"()\[\]]+@[^\s<>,;:"()\[\]]+`)
+)
+
+// Parses an address list header (From, To, Cc...), decoding RFC 2047 display names
+func parseAddressList(value string) database.AddressList {
+	if strings.TrimSpace(value) == "" {
+		return nil
+	}
+
+	list := database.AddressList{}
+
+	if addresses, err := address_parser.ParseList(value); err == nil {
+		for _, address := range addresses {
+			list = append(list, database.Address{Name: ensureUTF8(address.Name), Address: ensureUTF8(address.Address)})
+		}
+
+		return list
+	}
+
+	// Not RFC 5322 compliant, salvage whatever looks like an address
+	for _, address := range email_regex.FindAllString(value, -1) {
+		list = append(list, database.Address{Address: ensureUTF8(address)})
+	}
+
+	return list
+}
+
+// Gets the message IDs from a Message-ID, In-Reply-To or References header, without the angle brackets
+func parseMessageIDs(value string) database.StringList {
+	var ids database.StringList
+
+	for _, matches := range message_id_regex.FindAllStringSubmatch(value, -1) {
+		ids = append(ids, ensureUTF8(matches[1]))
+	}
+
+	// Some senders skip the brackets
+	if len(ids) == 0 && strings.TrimSpace(value) != "" && !strings.ContainsAny(strings.TrimSpace(value), " \t") {
+		ids = append(ids, ensureUTF8(strings.TrimSpace(value)))
+	}
+
+	return ids
+}
+
+// Whether the envelope sender's domain doesn't match any of the header From's,
+// a legit bounce address (empty envelope sender) is never considered spoofed
+func isSenderMismatch(envelope_from string, header_from database.AddressList) bool {
+	if envelope_from == "" || len(header_from) == 0 {
+		return false
+	}
+
+	envelope_domain := addressDomain(envelope_from)
+
+	for _, address := range header_from {
+		if domain := addressDomain(address.Address); domain == envelope_domain || strings.HasSuffix(envelope_domain, "."+domain) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func addressDomain(address string) string {
+	if idx := strings.LastIndex(address, "@"); idx != -1 {
+		return database.NormalizeDomain(address[idx+1:])
+	}
+
+	return ""
+}
+
+// Internationalized domains are looked up in DNS in their ASCII (punycode) form
+func asciiDomain(domain string) string {
+	if ascii, err := idna.Lookup.ToASCII(domain); err == nil {
+		return ascii
+	}
+
+	return domain
+}
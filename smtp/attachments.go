@@ -0,0 +1,56 @@
+package smtp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"path"
+	"strings"
+
+	"gotemp/database"
+)
+
+// Builds the database models for the attachments found by the parser
+func makeAttachments(parts []*MimePart) []database.Attachment {
+	attachments := make([]database.Attachment, 0, len(parts))
+
+	for index, part := range parts {
+		checksum := sha256.Sum256(part.Body)
+		content_id := strings.Trim(part.Header.Get("Content-ID"), "<> \t")
+
+		attachments = append(attachments, database.Attachment{
+			Filename:    attachmentFilename(part, index),
+			ContentType: part.ContentType,
+			Size:        len(part.Body),
+			Checksum:    hex.EncodeToString(checksum[:]),
+			ContentID:   content_id,
+			Inline:      content_id != "" && !part.IsAttachment(),
+			Data:        part.Body,
+		})
+	}
+
+	return attachments
+}
+
+// Gets a safe file name for the attachment, making one up if the sender didn't give any
+func attachmentFilename(part *MimePart, index int) string {
+	// Some clients (Outlook) send RFC 2047 encoded names instead of RFC 2231 ones
+	name := decodeMimeHeader(part.Filename())
+
+	// Don't trust the sender with paths
+	name = strings.ReplaceAll(name, "\\", "/")
+	name = strings.TrimSpace(path.Base(name))
+
+	if name != "" && name != "." && name != "/" && name != ".." {
+		return name
+	}
+
+	name = fmt.Sprintf("attachment-%d", index+1)
+
+	if extensions, err := mime.ExtensionsByType(part.ContentType); err == nil && len(extensions) > 0 {
+		name += extensions[0]
+	}
+
+	return name
+}
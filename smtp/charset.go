@@ -0,0 +1,65 @@
+package smtp
+
+import (
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+)
+
+// Converts a text part's body to UTF-8, using its charset parameter when there's one
+// and guessing otherwise
+func decodePartCharset(part *MimePart) string {
+	var enc encoding.Encoding
+
+	// Mislabeled UTF-8 is treated as unlabeled
+	if part.Charset != "" {
+		if found, name := charset.Lookup(part.Charset); name != "utf-8" || utf8.Valid(part.Body) {
+			enc = found
+		}
+	}
+
+	// No (known) charset, HTML bodies may still declare it in a <meta> tag
+	if enc == nil && part.ContentType == "text/html" {
+		if guess, _, certain := charset.DetermineEncoding(part.Body, "text/html"); certain {
+			enc = guess
+		}
+	}
+
+	return decodeCharset(part.Body, enc)
+}
+
+// Converts text to UTF-8, text in an unknown encoding is assumed to be UTF-8 if it
+// looks like it, Windows-1252 (the de-facto default of old clients) otherwise
+func decodeCharset(data []byte, enc encoding.Encoding) string {
+	if enc == nil {
+		if utf8.Valid(data) {
+			return string(data)
+		}
+
+		enc = charmap.Windows1252
+	}
+
+	if decoded, err := enc.NewDecoder().Bytes(data); err == nil {
+		data = decoded
+	}
+
+	return strings.ToValidUTF8(string(data), "�")
+}
+
+// Used by mime.WordDecoder for RFC 2047 words not in UTF-8, US-ASCII or ISO-8859-1
+func charsetReader(label string, input io.Reader) (io.Reader, error) {
+	return charset.NewReaderLabel(label, input)
+}
+
+// Makes sure a string is valid UTF-8, fixing raw 8-bit text sent without any encoding
+func ensureUTF8(s string) string {
+	if utf8.ValidString(s) {
+		return s
+	}
+
+	return decodeCharset([]byte(s), nil)
+}
@@ -0,0 +1,113 @@
+package smtp
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Open connections by ID, so that sessions can find theirs
+var connections sync.Map
+
+// ID of the last connection accepted
+var connection_id uint64
+
+type trackListener struct {
+	net.Listener
+}
+
+func trackConnections(listener net.Listener) net.Listener {
+	return trackListener{Listener: listener}
+}
+
+func (l trackListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+
+	if err != nil {
+		return nil, err
+	}
+
+	tracked := &trackedConn{Conn: conn, id: atomic.AddUint64(&connection_id, 1), connected_at: time.Now()}
+	connections.Store(tracked.id, tracked)
+
+	return tracked, nil
+}
+
+// An accepted connection, which outlives the sessions go-smtp starts on it (at each greeting).
+// Sessions get when it was opened and how the client greeted from it, and can drop it
+type trackedConn struct {
+	net.Conn
+	id           uint64
+	connected_at time.Time
+	once         sync.Once
+	hangup       int32    // Set to close the connection once the next reply is written
+	session      *Session // Current one
+	greetingSniffer
+}
+
+// A tracked connection's remote address along with its ID, which sessions find it by
+// since addresses don't tell Unix socket clients apart
+type trackedAddr struct {
+	net.Addr
+	id uint64
+}
+
+func (c *trackedConn) RemoteAddr() net.Addr {
+	return trackedAddr{Addr: c.Conn.RemoteAddr(), id: c.id}
+}
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+
+	if !c.sniffed {
+		c.sniffGreeting(b[:n])
+	}
+
+	return n, err
+}
+
+func (c *trackedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+
+	if atomic.LoadInt32(&c.hangup) == 1 {
+		c.Close()
+	}
+
+	return n, err
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() { connections.Delete(c.id) })
+
+	return c.Conn.Close()
+}
+
+// Makes the session the connection's current one. go-smtp drops the previous one without
+// resetting it when the client greets again, so its mailbox sessions are ended here
+func (c *trackedConn) startSession(session *Session) {
+	if c.session != nil {
+		c.session.endMailBoxSessions()
+	}
+
+	c.session = session
+}
+
+// Closes the connection right after the reply currently being prepared
+func (c *trackedConn) hangUpAfterReply() {
+	atomic.StoreInt32(&c.hangup, 1)
+}
+
+func findConnection(addr net.Addr) *trackedConn {
+	tracked_addr, ok := addr.(trackedAddr)
+
+	if !ok {
+		return nil
+	}
+
+	if conn, ok := connections.Load(tracked_addr.id); ok {
+		return conn.(*trackedConn)
+	}
+
+	return nil
+}
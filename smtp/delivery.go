@@ -0,0 +1,134 @@
+package smtp
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"gotemp/database"
+	"gotemp/http"
+
+	"github.com/emersion/go-smtp"
+	"gorm.io/gorm"
+)
+
+var errDeliveryFailed = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+	Message:      "Couldn't store the message, try again later",
+}
+
+// A received message, parsed once and then delivered to every recipient
+type incomingMessage struct {
+	data    []byte
+	parsed  *ParsedMail
+	subject string
+	raw_id  string
+
+	authentication database.Authentication
+	envelope       database.Envelope
+}
+
+// Parses and stores the raw message, returns nil if there's nothing worth delivering
+func prepareMessage(b []byte) (*incomingMessage, error) {
+	data := string(b)
+
+	// Parse email headers (simple)
+	headers, err := GetHeaders(data)
+
+	if err != nil {
+		DebugPrintln("Error parsing headers")
+		return nil, errors.New("error parsing email headers")
+	}
+
+	// Parse headers & body to save them later
+	parsed := ParseData(data, false)
+
+	if parsed.Body == "" && len(parsed.Attachments) == 0 {
+		// Parse again but this time log out what's happening
+		ParseData(data, true)
+
+		return nil, nil
+	}
+
+	// Keep the message exactly as it arrived
+	raw_id, err := database.StoreRawMessage(db, b)
+
+	if err != nil {
+		log.Println("Error saving raw message:", err)
+	}
+
+	return &incomingMessage{data: b, parsed: parsed, subject: decodeMimeHeader(headers.Get("Subject")), raw_id: raw_id}, nil
+}
+
+// Gets the reply refusing mail for a locked mailbox, nil if it's not locked
+// or its mail is accepted and discarded
+func lockedMailBoxError(mailbox *database.MailBox) error {
+	if !mailbox.Locked {
+		return nil
+	}
+
+	switch mailbox.LockedBehavior {
+	case database.LockedReject:
+		return &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 2, 1}, Message: "Mailbox is locked"}
+	case database.LockedDefer:
+		return &smtp.SMTPError{Code: 450, EnhancedCode: smtp.EnhancedCode{4, 2, 1}, Message: "Mailbox is temporarily unavailable"}
+	}
+
+	return nil
+}
+
+// Saves a copy of the message in the recipient's mailbox
+func deliver(message *incomingMessage, from string, rcpt recipient) error {
+	// Just ignore the email if the mailbox is locked (and not refusing mail)
+	if rcpt.mailbox.Locked {
+		log.Println("Locked mailbox: " + rcpt.address)
+		return nil
+	}
+
+	parsed := message.parsed
+
+	// Save mail to the database
+	model := database.Mail{
+		Subject:        message.subject,
+		From:           from,
+		To:             rcpt.address,
+		Tag:            rcpt.tag,
+		HeaderFrom:     parsed.From,
+		HeaderTo:       parsed.To,
+		HeaderCc:       parsed.Cc,
+		ReplyTo:        parsed.ReplyTo,
+		MessageID:      parsed.MessageID,
+		InReplyTo:      parsed.InReplyTo,
+		References:     parsed.References,
+		SenderMismatch: isSenderMismatch(from, parsed.From),
+		Authentication: message.authentication,
+		Envelope:       message.envelope,
+		Body:           parsed.Body,
+		HTMLBody:       parsed.HTMLBody,
+		TextBody:       parsed.TextBody,
+		Headers:        parsed.Headers,
+		HeaderFields:   makeHeaderModels(parsed.HeaderFields),
+		Attachments:    makeAttachments(parsed.Attachments),
+		RawMessageID:   message.raw_id,
+		MailBoxID:      rcpt.mailbox.ID,
+	}
+
+	if q := db.Create(&model); q.Error != nil {
+		log.Println("Error saving mail for "+rcpt.address+":", q.Error)
+		return errDeliveryFailed
+	}
+
+	// Update mailbox's last email time
+	db.Model(rcpt.mailbox).UpdateColumns(map[string]interface{}{
+		"last_email_at": time.Now(),
+		"unread_count":  gorm.Expr("unread_count + 1"),
+	})
+
+	// Send the new email over socket to clients, with the same HTML the API gives
+	email := model
+	http.RewriteInlineImages(rcpt.mailbox.ID, &email)
+	http.SendSocketMessage("NEW_EMAIL", map[string]interface{}{"mailbox_id": rcpt.mailbox.ID, "email": email})
+
+	return nil
+}
@@ -0,0 +1,133 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"time"
+
+	"gotemp/database"
+)
+
+// Names TLS versions the way they're usually written in trace headers
+var tls_versions = map[uint16]string{
+	tls.VersionTLS10: "TLS1.0",
+	tls.VersionTLS11: "TLS1.1",
+	tls.VersionTLS12: "TLS1.2",
+	tls.VersionTLS13: "TLS1.3",
+}
+
+// First byte of a TLS handshake record, what an implicit TLS client starts with
+const tls_handshake_record = 0x16
+
+// Finds out which greeting (HELO, EHLO or LHLO) a client used. go-smtp gives sessions no other
+// way to tell HELO from EHLO, so the command lines preceding the first greeting are read off the
+// wire. That's only possible in plaintext, the greeting stays unknown over implicit TLS
+type greetingSniffer struct {
+	greeting string
+	sniffed  bool
+	line     []byte // Start of the command line being read
+}
+
+func (g *greetingSniffer) sniffGreeting(b []byte) {
+	for _, char := range b {
+		switch {
+		case g.sniffed:
+			return
+		case char == '\n':
+			g.line = g.line[:0]
+		case len(g.line) < 4:
+			g.line = append(g.line, char)
+
+			if len(g.line) == 1 && char == tls_handshake_record {
+				g.sniffed = true
+			}
+
+			if verb := strings.ToUpper(string(g.line)); verb == "HELO" || verb == "EHLO" || verb == "LHLO" {
+				g.greeting, g.sniffed = verb, true
+			}
+		}
+	}
+}
+
+// Gets the protocol the message was received with, as registered for the Received
+// header's "with" clause (RFC 3848): "SMTP", "ESMTP", "ESMTPS", "ESMTPSA", "LMTPA"...
+func (s *Session) protocol() string {
+	protocol := "ESMTP"
+
+	if s.lmtp {
+		protocol = "LMTP"
+	} else if s.greeting == "HELO" && s.tls == nil && s.user == nil {
+		// Only extended sessions have the TLS and authentication variants
+		return "SMTP"
+	}
+
+	if s.tls != nil {
+		protocol += "S"
+	}
+
+	if s.user != nil {
+		protocol += "A"
+	}
+
+	return protocol
+}
+
+func (s *Session) envelope(size int, received_at time.Time) database.Envelope {
+	envelope := database.Envelope{
+		Protocol:         s.protocol(),
+		Helo:             s.helo,
+		Size:             size,
+		SessionStartedAt: s.started_at,
+		ReceivedAt:       received_at,
+	}
+
+	if s.remote_ip != nil {
+		envelope.RemoteIP = s.remote_ip.String()
+	}
+
+	if s.tls != nil {
+		envelope.TLSVersion = tls_versions[s.tls.Version]
+		envelope.TLSCipher = tls.CipherSuiteName(s.tls.CipherSuite)
+	}
+
+	if s.user != nil {
+		envelope.User = s.user.Username
+	}
+
+	for _, rcpt := range s.recipients {
+		envelope.Recipients = append(envelope.Recipients, rcpt.address)
+	}
+
+	return envelope
+}
+
+// Builds the Received header (RFC 5321 section 4.4) tracing the message's way in,
+// the recipient only being named when there's a single one
+func (s *Session) receivedHeader(received_at time.Time) []byte {
+	var header strings.Builder
+
+	header.WriteString("Received: from " + s.helo)
+
+	if s.remote_ip != nil {
+		header.WriteString(" ([" + s.remote_ip.String() + "])")
+	}
+
+	header.WriteString("\r\n\tby " + server_domain + " (GoTemp) with " + s.protocol())
+
+	if s.tls != nil {
+		header.WriteString(fmt.Sprintf("\r\n\t(%s %s)", tls_versions[s.tls.Version], tls.CipherSuiteName(s.tls.CipherSuite)))
+	}
+
+	if s.user != nil {
+		header.WriteString("\r\n\t(authenticated as " + s.user.Username + ")")
+	}
+
+	if len(s.recipients) == 1 {
+		header.WriteString("\r\n\tfor <" + s.recipients[0].address + ">")
+	}
+
+	header.WriteString("; " + received_at.Format(time.RFC1123Z) + "\r\n")
+
+	return []byte(header.String())
+}
@@ -0,0 +1,150 @@
+package smtp
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"gotemp/database"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Serializes fault rule hit counting
+var fault_lock sync.Mutex
+
+// Only seen by clients when there was no connection to drop, a temporary failure
+// so that an MTA retries rather than bounces
+var errConnectionDropped = &smtp.SMTPError{
+	Code:         421,
+	EnhancedCode: smtp.EnhancedCode{4, 4, 2},
+	Message:      "Connection dropped",
+}
+
+// Usual enhanced codes of the reply codes faults are typically injected with
+var fault_enhanced_codes = map[int]smtp.EnhancedCode{
+	421: {4, 3, 2},
+	450: {4, 2, 1},
+	451: {4, 3, 0},
+	452: {4, 2, 2},
+	550: {5, 1, 1},
+	552: {5, 3, 4},
+	554: {5, 0, 0},
+}
+
+// Counts a hit on each of the mailbox's rules for the stage, returns the first one triggering
+func triggeredFault(mailbox *database.MailBox, stage string) *database.FaultRule {
+	fault_lock.Lock()
+	defer fault_lock.Unlock()
+
+	var rules []database.FaultRule
+	var triggered *database.FaultRule
+
+	db.Scopes(database.FaultOrder).Where("mail_box_id = ? AND stage = ?", mailbox.ID, stage).Find(&rules)
+
+	for i := range rules {
+		rule := &rules[i]
+		rule.Hits++
+
+		db.Model(rule).UpdateColumn("hits", rule.Hits)
+
+		if triggered == nil && (rule.Nth == 0 || rule.Nth == rule.Hits) {
+			triggered = rule
+		}
+	}
+
+	return triggered
+}
+
+// Misbehaves as the rule says: waits, then drops the connection or
+// returns the error to reply with (nil to reply as usual)
+func (s *Session) injectFault(rule *database.FaultRule, address string) error {
+	log.Printf("Injecting %s fault for %s (code: %d, delay: %dms, disconnect: %t)\n", rule.Stage, address, rule.Code, rule.DelayMs, rule.Disconnect)
+
+	if rule.DelayMs > 0 {
+		time.Sleep(time.Duration(rule.DelayMs) * time.Millisecond)
+	}
+
+	if rule.Disconnect {
+		if s.conn != nil {
+			s.conn.Close()
+		}
+
+		return errConnectionDropped
+	}
+
+	if rule.Code == 0 {
+		return nil
+	}
+
+	// 421 means the server is closing the connection
+	if rule.Code == 421 && s.conn != nil {
+		s.conn.hangUpAfterReply()
+	}
+
+	enhanced_code, ok := fault_enhanced_codes[rule.Code]
+
+	if !ok {
+		enhanced_code = smtp.EnhancedCode{rule.Code / 100, 0, 0}
+	}
+
+	message := rule.Message
+
+	if message == "" {
+		message = "Injected fault"
+	}
+
+	return &smtp.SMTPError{Code: rule.Code, EnhancedCode: enhanced_code, Message: message}
+}
+
+// A data fault triggering for one of the recipients' mailboxes
+type dataFault struct {
+	rule *database.FaultRule
+	rcpt recipient
+}
+
+// Gets the data faults triggering for the recipients' mailboxes, in the recipients' order
+func (s *Session) dataFaults() []dataFault {
+	var faults []dataFault
+
+	for _, rcpt := range s.uniqueRecipients() {
+		if rcpt.mailbox == nil {
+			continue
+		}
+
+		if rule := triggeredFault(rcpt.mailbox, database.FaultData); rule != nil {
+			faults = append(faults, dataFault{rule: rule, rcpt: rcpt})
+		}
+	}
+
+	return faults
+}
+
+// Applies each LMTP recipient's data fault to its mailbox only, returns the recipients
+// still getting the message. Dropping the connection ends the whole transaction though
+func (s *Session) injectDataFaults(faults []dataFault, recipients []recipient, results map[string]error) ([]recipient, error) {
+	var remaining []recipient
+
+	for _, rcpt := range recipients {
+		var err error
+
+		for _, fault := range faults {
+			if rcpt.mailbox != nil && fault.rcpt.mailbox.ID == rcpt.mailbox.ID {
+				err = s.injectFault(fault.rule, rcpt.address)
+			}
+		}
+
+		if err == errConnectionDropped {
+			return nil, err
+		}
+
+		if err != nil {
+			results[rcpt.mailbox.ID] = err
+			continue
+		}
+
+		remaining = append(remaining, rcpt)
+	}
+
+	return remaining, nil
+}
@@ -0,0 +1,57 @@
+package smtp
+
+import (
+	"strings"
+
+	"gotemp/database"
+)
+
+// A single header line, in the order it appeared in the message
+type HeaderField struct {
+	Name     string
+	Value    string // RFC 2047 decoded
+	RawValue string // Unfolded, but otherwise as received
+}
+
+// Splits a header block into its fields, unfolding the ones spanning multiple lines
+func parseHeaderFields(headers string) []HeaderField {
+	var fields []HeaderField
+
+	for _, line := range strings.Split(normalizeNewlines(headers), "\n") {
+		// Continuation of the previous field
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(fields) > 0 {
+			fields[len(fields)-1].RawValue += line
+			continue
+		}
+
+		idx := strings.Index(line, ":")
+
+		if idx <= 0 {
+			continue
+		}
+
+		fields = append(fields, HeaderField{Name: strings.TrimSpace(line[:idx]), RawValue: line[idx+1:]})
+	}
+
+	for i := range fields {
+		fields[i].RawValue = strings.TrimSpace(fields[i].RawValue)
+		fields[i].Value = decodeMimeHeader(fields[i].RawValue)
+	}
+
+	return fields
+}
+
+func makeHeaderModels(fields []HeaderField) []database.MailHeader {
+	headers := make([]database.MailHeader, 0, len(fields))
+
+	for index, field := range fields {
+		headers = append(headers, database.MailHeader{
+			Position: index,
+			Name:     field.Name,
+			Value:    field.Value,
+			RawValue: field.RawValue,
+		})
+	}
+
+	return headers
+}
@@ -0,0 +1,107 @@
+package smtp
+
+import (
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+var (
+	html_spaces_regex   = regexp.MustCompile(`[ \t\r\n\f]+`)
+	html_newlines_regex = regexp.MustCompile(`\n[ \t]*\n(\s*\n)+`)
+)
+
+// Tags whose contents are never shown to the reader
+var html_hidden_tags = map[string]bool{"head": true, "script": true, "style": true, "title": true, "template": true}
+
+// Tags that start on a new line
+var html_block_tags = map[string]bool{
+	"address": true, "article": true, "aside": true, "blockquote": true, "dd": true, "div": true, "dl": true,
+	"dt": true, "footer": true, "form": true, "h1": true, "h2": true, "h3": true, "h4": true, "h5": true,
+	"h6": true, "header": true, "hr": true, "main": true, "nav": true, "ol": true, "p": true,
+	"pre": true, "section": true, "table": true, "tr": true, "ul": true,
+}
+
+// Generates a plain-text version of an HTML body, for mails that don't come with one
+func htmlToText(body string) string {
+	var sb strings.Builder
+	var link_href string
+	var link_start int
+	hidden := 0
+
+	tokenizer := html.NewTokenizer(strings.NewReader(body))
+
+	for {
+		token_type := tokenizer.Next()
+
+		if token_type == html.ErrorToken {
+			break
+		}
+
+		token := tokenizer.Token()
+
+		switch token_type {
+		case html.TextToken:
+			if hidden == 0 {
+				sb.WriteString(html_spaces_regex.ReplaceAllString(token.Data, " "))
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			if html_hidden_tags[token.Data] && token_type == html.StartTagToken {
+				hidden++
+			}
+
+			switch {
+			case token.Data == "br":
+				sb.WriteString("\n")
+			case token.Data == "li":
+				sb.WriteString("\n- ")
+			case token.Data == "td" || token.Data == "th":
+				sb.WriteString(" ")
+			case token.Data == "a":
+				link_href = getHtmlAttribute(token, "href")
+				link_start = sb.Len()
+			case html_block_tags[token.Data]:
+				sb.WriteString("\n\n")
+			}
+		case html.EndTagToken:
+			if html_hidden_tags[token.Data] && hidden > 0 {
+				hidden--
+			}
+
+			if token.Data == "a" {
+				// Show where links point to, unless the text is the URL already
+				text := strings.TrimSpace(sb.String()[link_start:])
+
+				if link_href != "" && !strings.HasPrefix(link_href, "#") && text != link_href && text != strings.TrimPrefix(link_href, "mailto:") {
+					sb.WriteString(" (" + link_href + ")")
+				}
+
+				link_href = ""
+			} else if html_block_tags[token.Data] {
+				sb.WriteString("\n\n")
+			}
+		}
+	}
+
+	// Drop the indentation left by the markup and collapse blank lines
+	lines := strings.Split(sb.String(), "\n")
+
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+	}
+
+	text := html_newlines_regex.ReplaceAllString(strings.Join(lines, "\n"), "\n\n")
+
+	return strings.TrimSpace(text)
+}
+
+func getHtmlAttribute(token html.Token, name string) string {
+	for _, attr := range token.Attr {
+		if attr.Key == name {
+			return attr.Val
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,101 @@
+package smtp
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"gotemp/database"
+
+	"github.com/emersion/go-smtp"
+	"gorm.io/gorm"
+)
+
+var errMailBoxSizeExceeded = &smtp.SMTPError{
+	Code:         552,
+	EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+	Message:      "Message too big for this mailbox",
+}
+
+// Caps the number of concurrent connections across listeners,
+// the ones over the limit are turned away with a 421
+type connectionLimiter struct {
+	slots chan struct{}
+}
+
+func newConnectionLimiter(max int) *connectionLimiter {
+	if max <= 0 {
+		return nil
+	}
+
+	return &connectionLimiter{slots: make(chan struct{}, max)}
+}
+
+func (l *connectionLimiter) wrap(listener net.Listener) net.Listener {
+	if l == nil {
+		return listener
+	}
+
+	return &limitListener{Listener: listener, limiter: l}
+}
+
+type limitListener struct {
+	net.Listener
+	limiter *connectionLimiter
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+
+		if err != nil {
+			return nil, err
+		}
+
+		select {
+		case l.limiter.slots <- struct{}{}:
+			return &limitConn{Conn: conn, release: func() { <-l.limiter.slots }}, nil
+		default:
+			log.Println("Too many connections, turning away", conn.RemoteAddr())
+			turnAway(conn, "Too many connections, try again later")
+		}
+	}
+}
+
+// Refuses a connection before the session even starts, in the background
+// so that a slow client doesn't hold up accepting the next ones
+func turnAway(conn net.Conn, message string) {
+	go func() {
+		conn.SetWriteDeadline(time.Now().Add(time.Second))
+		fmt.Fprintf(conn, "421 4.7.0 %s %s\r\n", server_domain, message)
+		conn.Close()
+	}()
+}
+
+// Frees its slot once closed
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+
+	return err
+}
+
+// Whether a message of the given size is over the mailbox's own limit, if it has one
+func exceedsMailBoxLimit(mailbox *database.MailBox, size int) bool {
+	return mailbox.MaxMessageBytes > 0 && size > mailbox.MaxMessageBytes
+}
+
+// Logs a message rejected for being too big and counts it on the mailbox
+func recordOversize(mailbox *database.MailBox, address string, limit int) {
+	log.Printf("Rejected message for %s: over the %d bytes limit\n", address, limit)
+
+	db.Model(mailbox).UpdateColumn("rejected_oversize", gorm.Expr("rejected_oversize + 1"))
+}
@@ -0,0 +1,67 @@
+package smtp
+
+import (
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Same as Data, with a reply per recipient
+func (s *Session) LMTPData(r io.Reader, status smtp.StatusCollector) error {
+	return s.receive(r, status)
+}
+
+// Serves LMTP for an MTA handing over the mail it receives, on a Unix socket
+// ("/path/to/socket" or "unix:/path/to/socket") or a TCP address ("127.0.0.1:24")
+func serveLMTP(s *smtp.Server, address string, limiter *connectionLimiter) {
+	lmtp := smtp.NewServer(&Backend{lmtp: true})
+
+	lmtp.LMTP = true
+	lmtp.Domain = s.Domain
+	lmtp.ReadTimeout = s.ReadTimeout
+	lmtp.WriteTimeout = s.WriteTimeout
+	lmtp.MaxMessageBytes = s.MaxMessageBytes
+	lmtp.MaxRecipients = s.MaxRecipients
+	lmtp.MaxLineLength = s.MaxLineLength
+	lmtp.EnableSMTPUTF8 = s.EnableSMTPUTF8
+	lmtp.EnableBINARYMIME = s.EnableBINARYMIME
+
+	network, path := "tcp", address
+
+	if strings.HasPrefix(address, "/") || strings.HasPrefix(address, "unix:") {
+		network, path = "unix", strings.TrimPrefix(address, "unix:")
+
+		// Left over by a previous run
+		if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+	}
+
+	listener, err := net.Listen(network, path)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if network == "unix" {
+		mode, err := strconv.ParseUint(Getenv("LMTP_SOCKET_MODE", "0660"), 8, 32)
+
+		if err != nil {
+			log.Fatalln("Invalid LMTP_SOCKET_MODE:", err)
+		}
+
+		if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+			log.Println("Error setting the LMTP socket's permissions:", err)
+		}
+	}
+
+	log.Println("Starting LMTP server at", address)
+	if err := lmtp.Serve(wrapListener(listener, limiter)); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,146 @@
+package smtp
+
+import (
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"gotemp/database"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Serves LMTP on a local port with a fresh database, in a temporary directory
+func startLMTP(t *testing.T) string {
+	dir, err := os.Getwd()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.Chdir(dir) })
+
+	db, err = database.Init()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server_domain = "example.com"
+	auth_checks = false
+
+	if err := database.EnsureDomains(db, []string{server_domain}); err != nil {
+		t.Fatal(err)
+	}
+
+	server := smtp.NewServer(&Backend{lmtp: true})
+	server.LMTP = true
+	server.Domain = server_domain
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+
+	return listener.Addr().String()
+}
+
+func createMailBox(t *testing.T, address string, max_message_bytes int) *database.MailBox {
+	domain, _ := database.FindDomain(db, server_domain)
+	mailbox := &database.MailBox{Name: address, Address: address, Domains: []database.Domain{*domain}, MaxMessageBytes: max_message_bytes}
+
+	if err := db.Create(mailbox).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	return mailbox
+}
+
+// Replies are matched on the recipients as the client wrote them, mail being routed and stored normalized
+func TestLMTPMixedCaseRecipients(t *testing.T) {
+	addr := startLMTP(t)
+	alice := createMailBox(t, "alice", 0)
+	bob := createMailBox(t, "bob", 10)
+
+	conn, err := net.Dial("tcp", addr)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := smtp.NewClientLMTP(conn, server_domain)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer client.Close()
+
+	if err := client.Hello("client.example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.Mail("sender@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	recipients := []string{"alice@Example.COM", "bob@EXAMPLE.com"}
+
+	for _, rcpt := range recipients {
+		if err := client.Rcpt(rcpt); err != nil {
+			t.Fatalf("RCPT TO %s: %v", rcpt, err)
+		}
+	}
+
+	statuses := make(map[string]*smtp.SMTPError)
+
+	w, err := client.LMTPData(func(rcpt string, status *smtp.SMTPError) {
+		statuses[rcpt] = status
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w.Write([]byte(strings.Join([]string{
+		"From: sender@example.org",
+		"To: alice@Example.COM, bob@EXAMPLE.com",
+		"Subject: Hello",
+		"",
+		"Hello there",
+		"",
+	}, "\r\n")))
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(statuses) != 2 {
+		t.Fatalf("got %d statuses, want 2: %v", len(statuses), statuses)
+	}
+
+	if status := statuses["alice@Example.COM"]; status != nil {
+		t.Errorf("alice@Example.COM: got %v, want success", status)
+	}
+
+	if status := statuses["bob@EXAMPLE.com"]; status == nil || status.Code != errMailBoxSizeExceeded.Code {
+		t.Errorf("bob@EXAMPLE.com: got %v, want %d", status, errMailBoxSizeExceeded.Code)
+	}
+
+	var mails []database.Mail
+
+	db.Where("mail_box_id IN ?", []string{alice.ID, bob.ID}).Find(&mails)
+
+	if len(mails) != 1 || mails[0].MailBoxID != alice.ID || mails[0].To != "alice@example.com" {
+		t.Errorf("got mails %+v, want a single one to alice@example.com", mails)
+	}
+}
@@ -0,0 +1,223 @@
+package smtp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"gotemp/database"
+
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/emersion/go-msgauth/dmarc"
+	"golang.org/x/net/publicsuffix"
+)
+
+// The DNS lookups sender authentication needs, *net.Resolver implements it
+type DNSResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+// Answers the SPF, DKIM and DMARC lookups, can be replaced (e.g. by a local fake in tests)
+var Resolver DNSResolver = net.DefaultResolver
+
+var auth_checks bool
+
+// How long the checks of a single message may take
+const auth_timeout = 15 * time.Second
+
+// Maximum number of DKIM signatures verified per message
+const dkim_max_verifications = 5
+
+// Makes a resolver querying the given DNS server ("host" or "host:port") instead of the system's
+func newDNSResolver(server string) *net.Resolver {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network string, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// Checks SPF for the connecting IP and envelope sender, the message's DKIM signatures,
+// and whether either is aligned with the From header's domain as DMARC requires
+func authenticateSender(data []byte, ip net.IP, helo string, from string, header_from database.AddressList) database.Authentication {
+	ctx, cancel := context.WithTimeout(context.Background(), auth_timeout)
+	defer cancel()
+
+	var auth database.Authentication
+
+	auth.SPF, auth.SPFDomain = checkSPF(ctx, Resolver, ip, from, helo)
+
+	spf_result := &authres.SPFResult{Value: authres.ResultValue(auth.SPF)}
+
+	if from != "" {
+		spf_result.From = from
+	} else {
+		spf_result.Helo = helo
+	}
+
+	results := []authres.Result{spf_result}
+
+	dkim_results := checkDKIM(ctx, data)
+
+	for _, result := range dkim_results {
+		if result.Value == authres.ResultPass {
+			auth.DKIMDomains = append(auth.DKIMDomains, result.Domain)
+		}
+
+		results = append(results, result)
+	}
+
+	auth.DKIM = dkimVerdict(dkim_results)
+
+	dmarc_result, policy := checkDMARC(ctx, header_from, auth)
+	auth.DMARC, auth.DMARCPolicy = string(dmarc_result.Value), policy
+	results = append(results, dmarc_result)
+
+	auth.Results = authres.Format(server_domain, results)
+
+	return auth
+}
+
+// Verifies each DKIM signature of the raw message
+func checkDKIM(ctx context.Context, data []byte) []*authres.DKIMResult {
+	verifications, err := dkim.VerifyWithOptions(bytes.NewReader(data), &dkim.VerifyOptions{
+		LookupTXT:        func(domain string) ([]string, error) { return Resolver.LookupTXT(ctx, domain) },
+		MaxVerifications: dkim_max_verifications,
+	})
+
+	if err != nil && !errors.Is(err, dkim.ErrTooManySignatures) {
+		return []*authres.DKIMResult{{Value: authres.ResultPermError, Reason: err.Error()}}
+	}
+
+	var results []*authres.DKIMResult
+
+	for _, verification := range verifications {
+		result := &authres.DKIMResult{Value: authres.ResultPass, Domain: verification.Domain, Identifier: verification.Identifier}
+
+		switch {
+		case verification.Err == nil:
+		case dkim.IsTempFail(verification.Err):
+			result.Value, result.Reason = authres.ResultTempError, verification.Err.Error()
+		case dkim.IsPermFail(verification.Err):
+			result.Value, result.Reason = authres.ResultPermError, verification.Err.Error()
+		default:
+			result.Value, result.Reason = authres.ResultFail, verification.Err.Error()
+		}
+
+		results = append(results, result)
+	}
+
+	if len(results) == 0 {
+		return []*authres.DKIMResult{{Value: authres.ResultNone}}
+	}
+
+	return results
+}
+
+// A message passes DKIM if any of its signatures is valid, or else gets its first signature's result
+func dkimVerdict(results []*authres.DKIMResult) string {
+	for _, result := range results {
+		if result.Value == authres.ResultPass {
+			return string(authres.ResultPass)
+		}
+	}
+
+	return string(results[0].Value)
+}
+
+// Evaluates the From domain's DMARC policy, returns the result and the requested policy
+func checkDMARC(ctx context.Context, header_from database.AddressList, auth database.Authentication) (*authres.DMARCResult, string) {
+	// DMARC applies to messages with a single author domain
+	if len(header_from) != 1 {
+		return &authres.DMARCResult{Value: authres.ResultNone}, ""
+	}
+
+	domain := asciiDomain(addressDomain(header_from[0].Address))
+	result := &authres.DMARCResult{Value: authres.ResultNone, From: domain}
+
+	record, record_domain, err := lookupDMARC(ctx, domain)
+
+	switch {
+	case errors.Is(err, dmarc.ErrNoPolicy):
+		return result, ""
+	case dmarc.IsTempFail(err):
+		result.Value, result.Reason = authres.ResultTempError, err.Error()
+		return result, ""
+	case err != nil:
+		result.Value, result.Reason = authres.ResultPermError, err.Error()
+		return result, ""
+	}
+
+	policy := string(record.Policy)
+
+	// The organizational domain's record may ask for another policy for its subdomains,
+	// which only applies when the From domain has no record of its own
+	if record.SubdomainPolicy != "" && record_domain != domain {
+		policy = string(record.SubdomainPolicy)
+	}
+
+	result.Value = authres.ResultFail
+
+	if auth.SPF == spfPass && isAligned(auth.SPFDomain, domain, record.SPFAlignment) {
+		result.Value = authres.ResultPass
+	}
+
+	for _, dkim_domain := range auth.DKIMDomains {
+		if isAligned(dkim_domain, domain, record.DKIMAlignment) {
+			result.Value = authres.ResultPass
+		}
+	}
+
+	return result, policy
+}
+
+// Gets the domain's DMARC record, falling back to its organizational domain's,
+// along with the domain the record was found on
+func lookupDMARC(ctx context.Context, domain string) (*dmarc.Record, string, error) {
+	options := &dmarc.LookupOptions{LookupTXT: func(name string) ([]string, error) { return Resolver.LookupTXT(ctx, name) }}
+
+	record, err := dmarc.LookupWithOptions(domain, options)
+
+	if org := orgDomain(domain); errors.Is(err, dmarc.ErrNoPolicy) && org != domain {
+		record, err = dmarc.LookupWithOptions(org, options)
+		return record, org, err
+	}
+
+	return record, domain, err
+}
+
+// Strict alignment requires the exact same domain, relaxed (the default) the same organizational domain
+func isAligned(domain string, from_domain string, mode dmarc.AlignmentMode) bool {
+	if domain == "" {
+		return false
+	}
+
+	if mode == dmarc.AlignmentStrict {
+		return strings.EqualFold(domain, from_domain)
+	}
+
+	return orgDomain(domain) == orgDomain(from_domain)
+}
+
+// The registered domain under a public suffix ("example.co.uk" for "mail.example.co.uk")
+func orgDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	if org, err := publicsuffix.EffectiveTLDPlusOne(domain); err == nil {
+		return org
+	}
+
+	return domain
+}
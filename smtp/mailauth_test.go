@@ -0,0 +1,329 @@
+package smtp
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"net"
+	"strings"
+	"testing"
+
+	"gotemp/database"
+
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+// Makes the DKIM and DMARC checks look up records in the fake resolver for the test's duration
+func useResolver(t *testing.T, resolver *fakeResolver) {
+	previous := Resolver
+	Resolver = resolver
+
+	t.Cleanup(func() { Resolver = previous })
+}
+
+// Signs the message for the domain with a new key, which is published in the resolver
+func signDKIM(t *testing.T, resolver *fakeResolver, domain string, message string) string {
+	public_key, private_key, err := ed25519.GenerateKey(rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resolver.txt["test._domainkey."+domain] = []string{"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(public_key)}
+
+	var signed bytes.Buffer
+
+	if err := dkim.Sign(&signed, strings.NewReader(message), &dkim.SignOptions{Domain: domain, Selector: "test", Signer: private_key}); err != nil {
+		t.Fatal(err)
+	}
+
+	return signed.String()
+}
+
+const dkim_message = "From: alice@example.com\r\nTo: bob@example.org\r\nSubject: Hello\r\n\r\nHello there\r\n"
+
+func TestCheckDKIM(t *testing.T) {
+	tests := []struct {
+		name    string
+		prepare func(t *testing.T, resolver *fakeResolver) string // Gives the message to check
+		want    []authres.ResultValue
+		verdict string
+	}{
+		{
+			name: "unsigned",
+			prepare: func(t *testing.T, resolver *fakeResolver) string {
+				return dkim_message
+			},
+			want:    []authres.ResultValue{authres.ResultNone},
+			verdict: "none",
+		},
+		{
+			name: "valid signature",
+			prepare: func(t *testing.T, resolver *fakeResolver) string {
+				return signDKIM(t, resolver, "example.com", dkim_message)
+			},
+			want:    []authres.ResultValue{authres.ResultPass},
+			verdict: "pass",
+		},
+		{
+			name: "altered body",
+			prepare: func(t *testing.T, resolver *fakeResolver) string {
+				return strings.Replace(signDKIM(t, resolver, "example.com", dkim_message), "Hello there", "Hello you", 1)
+			},
+			want:    []authres.ResultValue{authres.ResultFail},
+			verdict: "fail",
+		},
+		{
+			name: "missing key",
+			prepare: func(t *testing.T, resolver *fakeResolver) string {
+				message := signDKIM(t, resolver, "example.com", dkim_message)
+				delete(resolver.txt, "test._domainkey.example.com")
+
+				return message
+			},
+			want:    []authres.ResultValue{authres.ResultPermError},
+			verdict: "permerror",
+		},
+		{
+			name: "key lookup failure",
+			prepare: func(t *testing.T, resolver *fakeResolver) string {
+				message := signDKIM(t, resolver, "example.com", dkim_message)
+				delete(resolver.txt, "test._domainkey.example.com")
+				resolver.failing["test._domainkey.example.com"] = true
+
+				return message
+			},
+			want:    []authres.ResultValue{authres.ResultTempError},
+			verdict: "temperror",
+		},
+		{
+			name: "one valid signature among others",
+			prepare: func(t *testing.T, resolver *fakeResolver) string {
+				message := signDKIM(t, resolver, "example.net", dkim_message)
+				delete(resolver.txt, "test._domainkey.example.net")
+
+				return signDKIM(t, resolver, "example.com", message)
+			},
+			want:    []authres.ResultValue{authres.ResultPass, authres.ResultPermError},
+			verdict: "pass",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resolver := &fakeResolver{txt: map[string][]string{}, failing: map[string]bool{}}
+			message := test.prepare(t, resolver)
+			useResolver(t, resolver)
+
+			results := checkDKIM(context.Background(), []byte(message))
+
+			if len(results) != len(test.want) {
+				t.Fatalf("got %d results, want %d", len(results), len(test.want))
+			}
+
+			for i, result := range results {
+				if result.Value != test.want[i] {
+					t.Errorf("result %d: got %s (%s), want %s", i, result.Value, result.Reason, test.want[i])
+				}
+			}
+
+			if verdict := dkimVerdict(results); verdict != test.verdict {
+				t.Errorf("got verdict %s, want %s", verdict, test.verdict)
+			}
+		})
+	}
+}
+
+func TestCheckDMARC(t *testing.T) {
+	tests := []struct {
+		name    string
+		records map[string][]string
+		failing []string
+		from    []string
+		auth    database.Authentication
+		want    authres.ResultValue
+		policy  string
+	}{
+		{
+			name: "no record",
+			from: []string{"alice@example.com"},
+			auth: database.Authentication{SPF: spfPass, SPFDomain: "example.com"},
+			want: authres.ResultNone,
+		},
+		{
+			name:    "several authors",
+			records: map[string][]string{"_dmarc.example.com": {"v=DMARC1; p=reject"}},
+			from:    []string{"alice@example.com", "bob@example.com"},
+			auth:    database.Authentication{SPF: spfPass, SPFDomain: "example.com"},
+			want:    authres.ResultNone,
+		},
+		{
+			name:    "spf aligned",
+			records: map[string][]string{"_dmarc.example.com": {"v=DMARC1; p=reject"}},
+			from:    []string{"alice@example.com"},
+			auth:    database.Authentication{SPF: spfPass, SPFDomain: "example.com"},
+			want:    authres.ResultPass,
+			policy:  "reject",
+		},
+		{
+			name:    "spf relaxed alignment",
+			records: map[string][]string{"_dmarc.example.com": {"v=DMARC1; p=reject"}},
+			from:    []string{"alice@example.com"},
+			auth:    database.Authentication{SPF: spfPass, SPFDomain: "bounces.example.com"},
+			want:    authres.ResultPass,
+			policy:  "reject",
+		},
+		{
+			name:    "spf strict alignment",
+			records: map[string][]string{"_dmarc.example.com": {"v=DMARC1; p=reject; aspf=s"}},
+			from:    []string{"alice@example.com"},
+			auth:    database.Authentication{SPF: spfPass, SPFDomain: "bounces.example.com"},
+			want:    authres.ResultFail,
+			policy:  "reject",
+		},
+		{
+			name:    "spf not passing",
+			records: map[string][]string{"_dmarc.example.com": {"v=DMARC1; p=quarantine"}},
+			from:    []string{"alice@example.com"},
+			auth:    database.Authentication{SPF: spfSoftFail, SPFDomain: "example.com"},
+			want:    authres.ResultFail,
+			policy:  "quarantine",
+		},
+		{
+			name:    "dkim relaxed alignment",
+			records: map[string][]string{"_dmarc.example.com": {"v=DMARC1; p=reject"}},
+			from:    []string{"alice@example.com"},
+			auth:    database.Authentication{SPF: spfFail, SPFDomain: "example.net", DKIMDomains: []string{"example.net", "mail.example.com"}},
+			want:    authres.ResultPass,
+			policy:  "reject",
+		},
+		{
+			name:    "dkim strict alignment",
+			records: map[string][]string{"_dmarc.example.com": {"v=DMARC1; p=reject; adkim=s"}},
+			from:    []string{"alice@example.com"},
+			auth:    database.Authentication{SPF: spfFail, SPFDomain: "example.net", DKIMDomains: []string{"mail.example.com"}},
+			want:    authres.ResultFail,
+			policy:  "reject",
+		},
+		{
+			name:    "public suffix",
+			records: map[string][]string{"_dmarc.example.co.uk": {"v=DMARC1; p=reject"}},
+			from:    []string{"alice@mail.example.co.uk"},
+			auth:    database.Authentication{SPF: spfPass, SPFDomain: "other.co.uk", DKIMDomains: []string{"example.co.uk"}},
+			want:    authres.ResultPass,
+			policy:  "reject",
+		},
+		{
+			name:    "other organizational domain under a public suffix",
+			records: map[string][]string{"_dmarc.example.co.uk": {"v=DMARC1; p=reject"}},
+			from:    []string{"alice@example.co.uk"},
+			auth:    database.Authentication{SPF: spfPass, SPFDomain: "other.co.uk"},
+			want:    authres.ResultFail,
+			policy:  "reject",
+		},
+		{
+			name:    "organizational domain fallback",
+			records: map[string][]string{"_dmarc.example.com": {"v=DMARC1; p=reject"}},
+			from:    []string{"alice@news.example.com"},
+			auth:    database.Authentication{SPF: spfPass, SPFDomain: "example.com"},
+			want:    authres.ResultPass,
+			policy:  "reject",
+		},
+		{
+			name:    "subdomain policy of the organizational domain",
+			records: map[string][]string{"_dmarc.example.com": {"v=DMARC1; p=reject; sp=quarantine"}},
+			from:    []string{"alice@news.example.com"},
+			auth:    database.Authentication{SPF: spfPass, SPFDomain: "example.net"},
+			want:    authres.ResultFail,
+			policy:  "quarantine",
+		},
+		{
+			name:    "subdomain policy of the domain's own record",
+			records: map[string][]string{"_dmarc.news.example.com": {"v=DMARC1; p=none; sp=reject"}},
+			from:    []string{"alice@news.example.com"},
+			auth:    database.Authentication{SPF: spfPass, SPFDomain: "example.net"},
+			want:    authres.ResultFail,
+			policy:  "none",
+		},
+		{
+			name:    "subdomain policy for the organizational domain itself",
+			records: map[string][]string{"_dmarc.example.com": {"v=DMARC1; p=reject; sp=none"}},
+			from:    []string{"alice@example.com"},
+			auth:    database.Authentication{SPF: spfPass, SPFDomain: "example.net"},
+			want:    authres.ResultFail,
+			policy:  "reject",
+		},
+		{
+			name:    "lookup failure",
+			failing: []string{"_dmarc.example.com"},
+			from:    []string{"alice@example.com"},
+			auth:    database.Authentication{SPF: spfPass, SPFDomain: "example.com"},
+			want:    authres.ResultTempError,
+		},
+		{
+			name:    "invalid record",
+			records: map[string][]string{"_dmarc.example.com": {"v=DMARC1; rua=mailto:dmarc@example.com"}},
+			from:    []string{"alice@example.com"},
+			auth:    database.Authentication{SPF: spfPass, SPFDomain: "example.com"},
+			want:    authres.ResultPermError,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resolver := &fakeResolver{txt: test.records, failing: map[string]bool{}}
+
+			for _, name := range test.failing {
+				resolver.failing[name] = true
+			}
+
+			useResolver(t, resolver)
+
+			var header_from database.AddressList
+
+			for _, address := range test.from {
+				header_from = append(header_from, database.Address{Address: address})
+			}
+
+			result, policy := checkDMARC(context.Background(), header_from, test.auth)
+
+			if result.Value != test.want || policy != test.policy {
+				t.Errorf("got %s (%s) with policy %q, want %s with policy %q", result.Value, result.Reason, policy, test.want, test.policy)
+			}
+		})
+	}
+}
+
+// SPF, DKIM and DMARC together, as checked on received mail
+func TestAuthenticateSender(t *testing.T) {
+	server_domain = "mx.example.org"
+
+	resolver := &fakeResolver{txt: map[string][]string{
+		"example.com":        {"v=spf1 ip4:192.0.2.0/24 -all"},
+		"_dmarc.example.com": {"v=DMARC1; p=reject"},
+	}}
+
+	message := signDKIM(t, resolver, "example.com", dkim_message)
+	useResolver(t, resolver)
+
+	header_from := database.AddressList{{Address: "alice@example.com"}}
+
+	auth := authenticateSender([]byte(message), net.ParseIP("203.0.113.1"), "mail.example.com", "alice@example.com", header_from)
+
+	if auth.SPF != spfFail || auth.DKIM != "pass" || auth.DMARC != "pass" || auth.DMARCPolicy != "reject" {
+		t.Errorf("got spf=%s dkim=%s dmarc=%s (p=%s), want spf=fail dkim=pass dmarc=pass (p=reject)", auth.SPF, auth.DKIM, auth.DMARC, auth.DMARCPolicy)
+	}
+
+	if len(auth.DKIMDomains) != 1 || auth.DKIMDomains[0] != "example.com" {
+		t.Errorf("got DKIM domains %v, want [example.com]", auth.DKIMDomains)
+	}
+
+	for _, part := range []string{"mx.example.org", "spf=fail", "dkim=pass", "dmarc=pass"} {
+		if !strings.Contains(auth.Results, part) {
+			t.Errorf("Authentication-Results %q doesn't contain %q", auth.Results, part)
+		}
+	}
+}
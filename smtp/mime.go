@@ -0,0 +1,209 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	b64 "encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	qp "mime/quotedprintable"
+	"net/textproto"
+	"strings"
+)
+
+// Nested multiparts deeper than this are kept as opaque leaves
+const maxMimeDepth = 32
+
+// A MimePart is a node of a parsed MIME message, the message itself being the root.
+// Multipart nodes hold their sub-parts in Children, every other node holds its
+// (transfer-decoded) content in Body.
+type MimePart struct {
+	Header            textproto.MIMEHeader `json:"-"`
+	ContentType       string               `json:"content_type"`
+	Params            map[string]string    `json:"params"`
+	Disposition       string               `json:"disposition"`
+	DispositionParams map[string]string    `json:"disposition_params"`
+	TransferEncoding  string               `json:"transfer_encoding"`
+	Charset           string               `json:"charset"`
+	Body              []byte               `json:"-"`
+	Children          []*MimePart          `json:"children"`
+}
+
+// Parses a whole RFC 5322 message (headers + body) into a MIME tree
+func ParseMime(data string) (*MimePart, error) {
+	reader := bufio.NewReader(strings.NewReader(data))
+
+	header, err := textproto.NewReader(reader).ReadMIMEHeader()
+
+	if err != nil && len(header) == 0 {
+		return nil, err
+	}
+
+	body, err := io.ReadAll(reader)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return parseMimePart(header, body, 0), nil
+}
+
+func parseMimePart(header textproto.MIMEHeader, body []byte, depth int) *MimePart {
+	part := &MimePart{
+		Header:            header,
+		ContentType:       "text/plain",
+		Params:            map[string]string{},
+		DispositionParams: map[string]string{},
+		TransferEncoding:  strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding"))),
+	}
+
+	// A broken parameter list still gives us the media type, so only bail when there's none
+	if value := header.Get("Content-Type"); value != "" {
+		if media_type, params, err := mime.ParseMediaType(value); media_type != "" {
+			part.ContentType = media_type
+
+			if err == nil {
+				part.Params = params
+			}
+		}
+	}
+
+	if value := header.Get("Content-Disposition"); value != "" {
+		if disposition, params, err := mime.ParseMediaType(value); disposition != "" {
+			part.Disposition = disposition
+
+			if err == nil {
+				part.DispositionParams = params
+			}
+		}
+	}
+
+	part.Charset = strings.ToLower(part.Params["charset"])
+
+	if part.IsMultipart() && part.Params["boundary"] != "" && depth < maxMimeDepth {
+		if children := parseMultipart(body, part.Params["boundary"], depth); len(children) > 0 {
+			part.Children = children
+			return part
+		}
+	}
+
+	part.Body = decodeTransferEncoding(body, part.TransferEncoding)
+
+	return part
+}
+
+// Splits a multipart body into its parts, stopping at the first malformed one
+func parseMultipart(body []byte, boundary string, depth int) []*MimePart {
+	var children []*MimePart
+
+	reader := multipart.NewReader(bytes.NewReader(body), boundary)
+
+	for {
+		// NextRawPart leaves the Content-Transfer-Encoding alone, we decode it ourselves
+		raw_part, err := reader.NextRawPart()
+
+		if err != nil {
+			break
+		}
+
+		data, err := io.ReadAll(raw_part)
+
+		if err != nil && len(data) == 0 {
+			break
+		}
+
+		children = append(children, parseMimePart(raw_part.Header, data, depth+1))
+	}
+
+	return children
+}
+
+func decodeTransferEncoding(body []byte, encoding string) []byte {
+	switch encoding {
+	case "base64":
+		// Encoded bodies are wrapped at 76 chars, the decoder doesn't like newlines
+		cleaned := strings.Map(func(r rune) rune {
+			if r == '\r' || r == '\n' || r == ' ' || r == '\t' {
+				return -1
+			}
+
+			return r
+		}, string(body))
+
+		if decoded, err := b64.StdEncoding.DecodeString(cleaned); err == nil {
+			return decoded
+		}
+
+		// Some senders strip the padding
+		if decoded, err := b64.RawStdEncoding.DecodeString(strings.TrimRight(cleaned, "=")); err == nil {
+			return decoded
+		}
+	case "quoted-printable":
+		if decoded, err := io.ReadAll(qp.NewReader(bytes.NewReader(body))); err == nil {
+			return decoded
+		}
+	}
+
+	return body
+}
+
+func (p *MimePart) IsMultipart() bool {
+	return strings.HasPrefix(p.ContentType, "multipart/")
+}
+
+// Whether the part is meant to be downloaded rather than displayed
+func (p *MimePart) IsAttachment() bool {
+	return p.Disposition == "attachment"
+}
+
+// Gets the part's file name, if any
+func (p *MimePart) Filename() string {
+	if name := p.DispositionParams["filename"]; name != "" {
+		return name
+	}
+
+	return p.Params["name"]
+}
+
+// Calls fn for the part and every part below it, depth-first, stopping early when fn returns false
+func (p *MimePart) Walk(fn func(part *MimePart) bool) bool {
+	if !fn(p) {
+		return false
+	}
+
+	for _, child := range p.Children {
+		if !child.Walk(fn) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Finds the first displayable (non-attachment, non-multipart) part with the given MIME type
+func (p *MimePart) FindBody(mime_type string) *MimePart {
+	var found *MimePart
+
+	p.Walk(func(part *MimePart) bool {
+		if !part.IsMultipart() && !part.IsAttachment() && part.ContentType == mime_type {
+			found = part
+			return false
+		}
+
+		return true
+	})
+
+	return found
+}
+
+// Picks the body part to show, trying each MIME type in order of preference
+func (p *MimePart) PreferredBody(preferred_mimes ...string) *MimePart {
+	for _, mime_type := range preferred_mimes {
+		if part := p.FindBody(mime_type); part != nil && len(bytes.TrimSpace(part.Body)) != 0 {
+			return part
+		}
+	}
+
+	return nil
+}
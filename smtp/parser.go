@@ -2,23 +2,17 @@ package smtp
 
 import (
 	"bufio"
-	b64 "encoding/base64"
-	"io"
 	"log"
 	"mime"
-	qp "mime/quotedprintable"
 	"net/textproto"
 	"regexp"
-	"slices"
 	"strings"
-)
 
-var (
-	content_type_regex          = regexp.MustCompile(`(?im)^Content-Type:\s\w*\/\w*.*(\n\s.*.*)?`)
-	content_type_boundary_regex = regexp.MustCompile(`boundary\=\"?([^\"\r\n]{1,512})`)
-	content_encoding_Regex      = regexp.MustCompile(`(?im)^Content-Transfer-Encoding: (.*)$`)
+	"gotemp/database"
 )
 
+var content_encoding_Regex = regexp.MustCompile(`(?im)^Content-Transfer-Encoding: (.*)$`)
+
 func GetHeaders(data string) (*textproto.MIMEHeader, error) {
 	reader := textproto.NewReader(bufio.NewReader(strings.NewReader(data)))
 
@@ -32,200 +26,195 @@ func GetHeaders(data string) (*textproto.MIMEHeader, error) {
 }
 
 func decodeMimeHeader(headerContent string) string {
-	decoder := new(mime.WordDecoder)
+	decoder := &mime.WordDecoder{CharsetReader: charsetReader}
 	result, err := decoder.DecodeHeader(headerContent)
 
 	if err != nil {
-		return headerContent
+		return ensureUTF8(headerContent)
 	}
 
-	return result
+	return ensureUTF8(result)
 }
 
-func ParseData(data string, trace bool) (string, string) {
-	data = normalizeNewlines(data)
-	content_types := content_type_regex.FindAllString(data, 10)
-	dumb_parse := false
+// Body MIME types we'd rather show, in order of preference
+var preferred_mimes = []string{"text/html", "text/plain"}
+
+// The bits of a mail we store
+type ParsedMail struct {
+	Body     string // What to show by default, HTML if available
+	HTMLBody string
+	TextBody string // Generated from the HTML body when the mail has no text version
+	Headers  string
+
+	HeaderFields []HeaderField
+	Attachments  []*MimePart
+
+	From       database.AddressList
+	To         database.AddressList
+	Cc         database.AddressList
+	ReplyTo    database.AddressList
+	MessageID  string
+	InReplyTo  string
+	References database.StringList
+}
 
-	tracePrintf(trace, "Initializing parser, subject string: \"%s\"\n", data)
-	tracePrintln(trace, "Detected content-types: ", content_types)
-
-	if len(content_types) == 0 {
-		// Email has no content-type header, use dumb mode
-		dumb_parse = true
-		tracePrintln(trace, "Falling back to dumb paser due to no content_type")
-	} else {
-		preferred_mimes := []string{"text/html", "text/plain"}
-		var alternatives_boundary string
-		var mime_types []string
-
-		// Check if we should use any boundary (when there's multiple content options available)
-		for _, value := range content_types {
-			mime_type := getContentTypeHeaderValue(value)
-
-			if mime_type == "multipart/alternative" || mime_type == "multipart/mixed" {
-				tracePrintf(trace, "%s found (line: %s)\n", mime_type, value)
-
-				// Find boundary
-				if boundary_matches := content_type_boundary_regex.FindStringSubmatch(value); len(boundary_matches) == 2 {
-					alternatives_boundary = boundary_matches[1]
-					tracePrintf(trace, "multipart/alternative boundary found (%s)\n", alternatives_boundary)
-				}
-			} else if !strings.HasPrefix(mime_type, "multipart/") {
-				mime_types = append(mime_types, mime_type)
-			}
-		}
+func ParseData(data string, trace bool) *ParsedMail {
+	parsed := parseBody(data, trace)
+	parsed.HeaderFields = parseHeaderFields(parsed.Headers)
 
-		// Do we have multiple content options?
-		if alternatives_boundary != "" && len(mime_types) > 0 {
-			target_body := ""
-			target_mimetype := mime_types[0]
-
-			// Check if any of our preferred mime types were found
-			for _, preferred_mime := range preferred_mimes {
-				if slices.Contains(mime_types, preferred_mime) {
-					tracePrintf(trace, "Preferred MIME found: \"%s\"\n", preferred_mime)
-					target_mimetype = preferred_mime
-					break
-				}
-			}
+	parsed.From = parseAddressList(parsed.Header("From"))
+	parsed.To = parseAddressList(parsed.Header("To"))
+	parsed.Cc = parseAddressList(parsed.Header("Cc"))
+	parsed.ReplyTo = parseAddressList(parsed.Header("Reply-To"))
+	parsed.References = parseMessageIDs(parsed.Header("References"))
 
-			// Loop through all the boundary-delimited items
-			boundary_with_delimiter := "--" + alternatives_boundary
-			boundary_index := strings.Index(data, boundary_with_delimiter)
-
-			for boundary_index != 1 {
-				// The last boundary is followed by double dashes ("--")
-				// when we find them we know there's no other boundary left
-				// so we can break the loop
-				if data[boundary_index+len(boundary_with_delimiter):boundary_index+len(boundary_with_delimiter)+2] == "--" {
-					break
-				}
-
-				// Find the next boundary
-				next_boundary_index := indexAfter(data, boundary_with_delimiter, boundary_index+len(boundary_with_delimiter))
-				var boundary_contents string
-
-				if next_boundary_index != -1 {
-					// This should always be the case as even the last boundary-delimited
-					// item needs a closing boundary after the body
-					// but check nonetheless to avoid misconstructed emails
-					boundary_contents = data[boundary_index+len(boundary_with_delimiter) : next_boundary_index]
-				} else {
-					boundary_contents = data[boundary_index+len(boundary_with_delimiter):]
-				}
-
-				// Continue the loop
-				boundary_index = next_boundary_index
-
-				// Check if this boundary contains the desired mimetype
-				if content_type := content_type_regex.FindString(boundary_contents); content_type != "" {
-					mime_type := getContentTypeHeaderValue(content_type)
-
-					if mime_type == target_mimetype {
-						target_body = boundary_contents
-						break
-					}
-				}
-			}
+	if ids := parseMessageIDs(parsed.Header("Message-ID")); len(ids) > 0 {
+		parsed.MessageID = ids[0]
+	}
+
+	if ids := parseMessageIDs(parsed.Header("In-Reply-To")); len(ids) > 0 {
+		parsed.InReplyTo = ids[0]
+	}
+
+	return parsed
+}
+
+// Gets the raw value of the first header with the given name
+func (p *ParsedMail) Header(name string) string {
+	for _, field := range p.HeaderFields {
+		if strings.EqualFold(field.Name, name) {
+			return field.RawValue
+		}
+	}
+
+	return ""
+}
 
-			tracePrintf(trace, "Target MIME-type: \"%s\"\n", target_mimetype)
+func parseBody(data string, trace bool) *ParsedMail {
+	tracePrintf(trace, "Initializing parser, subject string: \"%s\"\n", data)
 
-			if target_body != "" {
-				tracePrintf(trace, "Body base string: \"%s\"\n", target_body)
+	root, err := ParseMime(data)
 
-				// Extract all the headers, getting only the body text/html
-				// it will come after the headers and an empty newline (\n\n)
-				if start_idx := strings.Index(target_body, "\n\n"); start_idx != -1 {
-					body := strings.Trim(target_body[start_idx+2:], "\t \n")
+	if err != nil {
+		tracePrintln(trace, "Couldn't build MIME tree, resorting to dumb parser: ", err)
+		return dumbParse(data, trace)
+	}
 
-					tracePrintf(trace, "Detected body: \"%s\"\n", body)
+	traceMimeTree(trace, root, 0)
 
-					if body != "" {
-						var encoding string
+	parsed := &ParsedMail{Headers: ensureUTF8(dumbParseHeaders(normalizeNewlines(data))), Attachments: collectAttachments(root)}
 
-						// Find message encoding
-						if matches := content_encoding_Regex.FindStringSubmatch(target_body[:start_idx]); matches != nil {
-							if len(matches) == 2 {
-								encoding = matches[1]
-							}
-						}
+	if part := root.PreferredBody("text/html"); part != nil {
+		parsed.HTMLBody = partText(part)
+	}
 
-						tracePrintf(trace, "Detected body encoding: \"%s\"\n", encoding)
+	if part := root.PreferredBody("text/plain"); part != nil {
+		parsed.TextBody = partText(part)
+	}
 
-						return decodeBody(body, encoding), dumbParseHeaders(data)
-					}
-				}
-			}
+	if part := selectBody(root); part != nil {
+		tracePrintf(trace, "Selected body part: \"%s\" (encoding: \"%s\")\n", part.ContentType, part.TransferEncoding)
 
-			// Body not found :(
-			// Try the dumb barser
-			tracePrintln(trace, "Body not found, resorting to dumb parser.")
-			dumb_parse = true
-		} else {
-			// Resort to dumb parser ¯\_(ツ)_/¯
-			dumb_parse = true
-			tracePrintln(trace, "No alternative boundary and/or first_mime, using dumb parser.")
-		}
+		parsed.Body = partText(part)
 	}
 
-	// In the dumb parser mode we just search for two newlinews (\n\n)
-	// Everything below the newlines is considered body
-	// and everything above is headers
-	if dumb_parse {
-		tracePrintln(trace, "Starting dumb parser...")
+	if parsed.Body == "" && len(parsed.Attachments) == 0 {
+		// Body not found :(
+		// Try the dumb barser
+		tracePrintln(trace, "Body not found, resorting to dumb parser.")
+		return dumbParse(data, trace)
+	}
 
-		if idx := strings.Index(data, "\n\n"); idx != -1 {
-			body := strings.Trim(data[idx+2:], "\t \n")
+	if parsed.TextBody == "" && parsed.HTMLBody != "" {
+		tracePrintln(trace, "No text/plain part, generating one from the HTML body")
+		parsed.TextBody = htmlToText(parsed.HTMLBody)
+	}
 
-			// Try to detect encoding
-			var encoding string
+	return parsed
+}
 
-			// Find message encoding
-			if matches := content_encoding_Regex.FindStringSubmatch(data[:idx]); matches != nil {
-				if len(matches) == 2 {
-					encoding = matches[1]
-				}
-			}
+// Gets every part that isn't meant to be shown as the mail body:
+// anything marked as an attachment plus every non-text leaf
+func collectAttachments(root *MimePart) []*MimePart {
+	var attachments []*MimePart
 
-			tracePrintf(trace, "Detected encoding: %s\n", encoding)
+	root.Walk(func(part *MimePart) bool {
+		if part.IsMultipart() || (len(part.Body) == 0 && !part.IsAttachment()) {
+			return true
+		}
 
-			return decodeBody(body, encoding), data[:idx]
+		if part.IsAttachment() || !strings.HasPrefix(part.ContentType, "text/") {
+			attachments = append(attachments, part)
 		}
-	}
 
-	return "", dumbParseHeaders(data)
+		return true
+	})
+
+	return attachments
 }
 
-func dumbParseHeaders(data string) string {
-	if idx := strings.Index(data, "\n\n"); idx != -1 {
-		return data[:idx]
+func partText(part *MimePart) string {
+	return strings.Trim(normalizeNewlines(decodePartCharset(part)), "\t \n")
+}
+
+// Picks the part to use as the mail body: the first preferred MIME type found,
+// or else the first displayable text part of any type
+func selectBody(root *MimePart) *MimePart {
+	if part := root.PreferredBody(preferred_mimes...); part != nil {
+		return part
 	}
 
-	return ""
+	var found *MimePart
+
+	root.Walk(func(part *MimePart) bool {
+		if !part.IsAttachment() && strings.HasPrefix(part.ContentType, "text/") && len(part.Body) != 0 {
+			found = part
+			return false
+		}
+
+		return true
+	})
+
+	return found
 }
 
-func decodeBody(body string, encoding string) string {
-	// Decode base64 if demanded (yes apparently this is a thing)
-	if encoding == "base64" {
-		bytes, err := b64.StdEncoding.DecodeString(body)
+// In the dumb parser mode we just search for two newlinews (\n\n)
+// Everything below the newlines is considered body
+// and everything above is headers
+func dumbParse(data string, trace bool) *ParsedMail {
+	tracePrintln(trace, "Starting dumb parser...")
+
+	data = normalizeNewlines(data)
+
+	if idx := strings.Index(data, "\n\n"); idx != -1 {
+		body := strings.Trim(data[idx+2:], "\t \n")
 
-		if err == nil {
-			return string(bytes[:])
+		// Try to detect encoding
+		var encoding string
+
+		// Find message encoding
+		if matches := content_encoding_Regex.FindStringSubmatch(data[:idx]); matches != nil {
+			if len(matches) == 2 {
+				encoding = strings.ToLower(strings.TrimSpace(matches[1]))
+			}
 		}
+
+		tracePrintf(trace, "Detected encoding: %s\n", encoding)
+
+		body = decodeCharset(decodeTransferEncoding([]byte(body), encoding), nil)
+
+		return &ParsedMail{Body: body, TextBody: body, Headers: ensureUTF8(data[:idx])}
 	}
 
-	// Decode quoted-printable if demanded
-	if encoding == "quoted-printable" {
-		reader := qp.NewReader(strings.NewReader(body))
-		bytes, err := io.ReadAll(reader)
+	return &ParsedMail{Headers: dumbParseHeaders(data)}
+}
 
-		if err == nil {
-			return string(bytes[:])
-		}
+func dumbParseHeaders(data string) string {
+	if idx := strings.Index(data, "\n\n"); idx != -1 {
+		return data[:idx]
 	}
 
-	return body
+	return ""
 }
 
 func normalizeNewlines(data string) string {
@@ -235,28 +224,6 @@ func normalizeNewlines(data string) string {
 	return data
 }
 
-// Similar to strings.Index, but with an offset
-func indexAfter(s string, substr string, after int) int {
-	result := strings.Index(s[after:], substr)
-
-	if result == -1 {
-		return -1
-	} else {
-		return result + after
-	}
-}
-
-// Gets the Content-Type header value from its whole line
-//
-// "Content-Type: text/plain; charset=us-ascii" => "text/plain"
-func getContentTypeHeaderValue(s string) string {
-	if idx := strings.Index(s, ";"); idx != -1 {
-		return s[14:idx]
-	} else {
-		return s[14:]
-	}
-}
-
 func tracePrintln(trace bool, v ...interface{}) {
 	if trace {
 		v = append([]interface{}{"[PARSER]: "}, v...)
@@ -270,3 +237,17 @@ func tracePrintf(trace bool, format string, v ...interface{}) {
 		log.Printf("[PARSER]: "+format, v...)
 	}
 }
+
+// Logs the MIME tree, one line per part
+func traceMimeTree(trace bool, part *MimePart, depth int) {
+	if !trace {
+		return
+	}
+
+	tracePrintf(trace, "%s%s (disposition: \"%s\", encoding: \"%s\", charset: \"%s\", %d bytes)\n",
+		strings.Repeat("  ", depth), part.ContentType, part.Disposition, part.TransferEncoding, part.Charset, len(part.Body))
+
+	for _, child := range part.Children {
+		traceMimeTree(trace, child, depth+1)
+	}
+}
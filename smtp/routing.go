@@ -0,0 +1,62 @@
+package smtp
+
+import (
+	"strings"
+
+	"gotemp/database"
+)
+
+// Characters separating a sub-address tag from the mailbox address ("qa+run123")
+var subaddress_separators string
+
+// Finds the mailbox a recipient's local part goes to, along with its sub-address tag (if any).
+// The full local part is tried before its base, so an existing "qa+vip" mailbox still gets
+// its mail, and exact mailboxes are tried before patterns, so a catch-all doesn't swallow
+// sub-addressed mail for an existing mailbox
+func routeRecipient(local_part string, domain_id string) (*database.MailBox, string, bool) {
+	base, tag := splitSubaddress(local_part)
+
+	if mailbox, ok := database.FindExactMailBox(db, local_part, domain_id); ok {
+		return mailbox, "", true
+	}
+
+	if tag != "" {
+		if mailbox, ok := database.FindExactMailBox(db, base, domain_id); ok {
+			return mailbox, tag, true
+		}
+	}
+
+	if mailbox, ok := database.FindPatternMailBox(db, local_part, domain_id); ok {
+		return mailbox, "", true
+	}
+
+	if tag != "" {
+		if mailbox, ok := database.FindPatternMailBox(db, base, domain_id); ok {
+			return mailbox, tag, true
+		}
+	}
+
+	return nil, "", false
+}
+
+// Splits "qa+run123" into "qa" and "run123"
+func splitSubaddress(local_part string) (string, string) {
+	if subaddress_separators == "" {
+		return local_part, ""
+	}
+
+	if idx := strings.IndexAny(local_part, subaddress_separators); idx > 0 && idx < len(local_part)-1 {
+		return local_part[:idx], local_part[idx+1:]
+	}
+
+	return local_part, ""
+}
+
+// Splits an address into its local part and domain
+func splitAddress(address string) (string, string) {
+	if idx := strings.LastIndex(address, "@"); idx != -1 {
+		return address[:idx], address[idx+1:]
+	}
+
+	return address, ""
+}
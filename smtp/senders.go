@@ -0,0 +1,41 @@
+package smtp
+
+import (
+	"net"
+
+	"gotemp/database"
+
+	"github.com/emersion/go-smtp"
+)
+
+var errSenderDenied = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+	Message:      "Sender not allowed",
+}
+
+// Checks the envelope sender and client IP against the global and mailbox's sender rules:
+// a matching deny rule refuses them, and so does having allow rules none of which match
+func isSenderAllowed(mailbox *database.MailBox, from string, ip net.IP) bool {
+	var rules []database.SenderRule
+
+	db.Scopes(database.SenderRulesFor(mailbox.ID)).Find(&rules)
+
+	allowlisted, allowed := false, false
+
+	for i := range rules {
+		matched := rules[i].Matches(from, ip)
+
+		switch rules[i].Action {
+		case database.SenderDeny:
+			if matched {
+				return false
+			}
+		case database.SenderAllow:
+			allowlisted = true
+			allowed = allowed || matched
+		}
+	}
+
+	return !allowlisted || allowed
+}
@@ -1,17 +1,21 @@
 package smtp
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"gotemp/database"
-	"gotemp/http"
+	"gotemp/proxy"
+	"gotemp/ratelimit"
 
 	"github.com/emersion/go-smtp"
 	"gorm.io/gorm"
@@ -20,33 +24,93 @@ import (
 // var db *gorm.DB
 // var debug = Getenv("DEBUG", "false") == "true"
 var (
-	db            *gorm.DB
-	debug         bool
-	server_domain string
+	db                *gorm.DB
+	debug             bool
+	server_domain     string
+	max_message_bytes int
+	trusted_proxies   []*net.IPNet // Set when PROXY protocol headers are accepted
 )
 
 // The Backend implements SMTP server methods.
-type Backend struct{}
+type Backend struct {
+	lmtp bool // Serving LMTP clients
+}
+
+func (bkd *Backend) NewSession(state smtp.ConnectionState, hostname string) (smtp.Session, error) {
+	session := &Session{
+		conn:       findConnection(state.RemoteAddr),
+		remote_ip:  remoteIP(state.RemoteAddr),
+		helo:       hostname,
+		lmtp:       bkd.lmtp,
+		started_at: time.Now(),
+	}
+
+	// The session is renewed by every greeting, STARTTLS included, the connection isn't
+	if session.conn != nil {
+		session.greeting = session.conn.greeting
+		session.started_at = session.conn.connected_at
+		session.conn.startSession(session)
+	}
 
-func (bkd *Backend) NewSession(_ smtp.ConnectionState, _ string) (smtp.Session, error) {
-	return &Session{}, nil
+	// A new session starts once STARTTLS is done
+	if state.TLS.HandshakeComplete {
+		session.tls = &state.TLS
+	}
+
+	return session, nil
 }
 
 // A Session is returned after EHLO.
 type Session struct {
-	from    string
-	to      string
+	conn             *trackedConn
+	remote_ip        net.IP
+	helo             string // HELO/EHLO name the client introduced itself with
+	greeting         string // HELO, EHLO or LHLO, empty when unknown (over implicit TLS)
+	lmtp             bool
+	tls              *tls.ConnectionState // Set when the connection is encrypted
+	started_at       time.Time
+	from             string
+	size             int // Message size declared in MAIL FROM, if any
+	recipients       []recipient
+	mailbox_sessions []string           // Mailboxes the transaction holds a rate limiting session for
+	user             *database.SMTPUser // Set once authenticated, their mail is captured rather than routed
+}
+
+// An accepted RCPT TO and the mailbox it's delivered to
+type recipient struct {
+	raw     string // RCPT TO argument as the client wrote it, LMTP replies are matched on it
+	address string
 	mailbox *database.MailBox
+	tag     string // Sub-address tag
 }
 
 func (s *Session) AuthPlain(username, password string) error {
-	return errors.New("invalid username or password")
+	user, ok := authenticateUser(username, password)
+
+	if !ok {
+		log.Println("Invalid SMTP credentials for user " + username)
+		return errors.New("invalid username or password")
+	}
+
+	s.user = user
+
+	return nil
 }
 
 func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
 	DebugPrintln("Mail from:", from)
 
-	s.from = from
+	if s.remote_ip != nil && !ratelimit.IPs.AllowMessage(s.remote_ip.String()) {
+		log.Println("Too many messages, throttling", s.remote_ip)
+		return errIPRateExceeded
+	}
+
+	// Internationalized addresses are stored normalized, like mailbox addresses and domains
+	s.from = database.NormalizeAddress(from)
+
+	if opts != nil {
+		s.size = opts.Size
+	}
 
 	return nil
 }
@@ -54,85 +118,213 @@ func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
 func (s *Session) Rcpt(to string) error {
 	DebugPrintln("Rcpt to:", to)
 
+	// Looked up and stored normalized
+	raw, to := to, database.NormalizeAddress(to)
+
+	// Authenticated users may send to anyone
+	if s.user != nil {
+		s.recipients = append(s.recipients, recipient{raw: raw, address: to})
+		return nil
+	}
+
+	local_part, domain_name := splitAddress(to)
+
 	// Check if the 'to' is valid
-	if !strings.HasSuffix(to, "@"+server_domain) {
+	domain, ok := database.FindDomain(db, domain_name)
+
+	if !ok {
 		log.Println("Invalid mailbox (1): " + to)
 		return errors.New("invalid 'to' address")
 	}
 
 	// Check if the target mailbox exists
-	var mailbox database.MailBox
+	mailbox, tag, ok := routeRecipient(local_part, domain.ID)
 
-	if q := db.Where("address = ?", strings.TrimSuffix(to, "@"+server_domain)).Limit(1).Find(&mailbox); q.RowsAffected == 0 {
+	if !ok {
 		log.Println("Invalid mailbox (2): " + to)
 		return errors.New("invalid 'to' address")
 	}
 
-	s.to = to
-	s.mailbox = &mailbox
+	if !isSenderAllowed(mailbox, s.from, s.remote_ip) {
+		log.Printf("Sender %s (%s) not allowed for %s\n", s.from, s.remote_ip, to)
+		return errSenderDenied
+	}
+
+	if err := lockedMailBoxError(mailbox); err != nil {
+		log.Println("Locked mailbox, refusing: " + to)
+		return err
+	}
+
+	// Don't wait for the data when the declared size already is too much
+	if exceedsMailBoxLimit(mailbox, s.size) {
+		recordOversize(mailbox, to, mailbox.MaxMessageBytes)
+		return errMailBoxSizeExceeded
+	}
+
+	if err := s.throttleMailBox(mailbox); err != nil {
+		log.Println("Too many messages, throttling mailbox of " + to)
+		return err
+	}
+
+	if rule := triggeredFault(mailbox, database.FaultRcpt); rule != nil {
+		if err := s.injectFault(rule, to); err != nil {
+			return err
+		}
+	}
+
+	s.recipients = append(s.recipients, recipient{raw: raw, address: to, mailbox: mailbox, tag: tag})
 
 	return nil
 }
 
 func (s *Session) Data(r io.Reader) error {
-	// Just ignore the email if the mailbox is locked
-	if s.mailbox.Locked {
-		log.Println("Locked mailbox: " + s.to)
-		return nil
+	return s.receive(r, nil)
+}
+
+// Receives the message for every recipient. Over LMTP each recipient gets its mailbox's outcome,
+// the error returned going to the ones without any, over SMTP it's the single reply for all of
+// them, which only fails when no mailbox got the message (or it's too big for any of them)
+func (s *Session) receive(r io.Reader, status smtp.StatusCollector) error {
+	// Outcome of the delivery to each mailbox, by ID
+	results := make(map[string]error)
+
+	err := s.receiveMessage(r, results)
+
+	if status != nil {
+		for _, rcpt := range s.recipients {
+			if rcpt.mailbox == nil {
+				continue
+			}
+
+			if result, ok := results[rcpt.mailbox.ID]; ok {
+				status.SetStatus(rcpt.raw, result)
+			}
+		}
+	}
+
+	return err
+}
+
+func (s *Session) receiveMessage(r io.Reader, results map[string]error) error {
+	faults := s.dataFaults()
+
+	// Over SMTP the first fault decides the reply, dropping the connection while the client is
+	// still sending. Over LMTP the data is read first, each fault only concerning its mailbox
+	if !s.lmtp && len(faults) > 0 && faults[0].rule.Disconnect {
+		return s.injectFault(faults[0].rule, faults[0].rcpt.address)
 	}
 
 	// Try to read data
-	if b, err := ioutil.ReadAll(r); err != nil {
+	b, err := ioutil.ReadAll(r)
+	received_at := time.Now()
+
+	if err == smtp.ErrDataTooLarge {
+		for _, rcpt := range s.uniqueRecipients() {
+			if rcpt.mailbox != nil {
+				recordOversize(rcpt.mailbox, rcpt.address, max_message_bytes)
+			}
+		}
+
 		return err
-	} else {
-		data := string(b)
+	}
 
-		// Parse email headers (simple)
-		headers, err := GetHeaders(data)
+	if err != nil {
+		return err
+	}
 
-		if err != nil {
-			DebugPrintln("Error parsing headers")
-			return errors.New("error parsing email headers")
+	// Leave out the mailboxes with a lower limit. Over SMTP the reply can't say the message only
+	// reached some mailboxes, so it's rejected for all of them, over LMTP only if that's all of them
+	var recipients []recipient
+	var oversize bool
+
+	for _, rcpt := range s.uniqueRecipients() {
+		if rcpt.mailbox != nil && exceedsMailBoxLimit(rcpt.mailbox, len(b)) {
+			recordOversize(rcpt.mailbox, rcpt.address, rcpt.mailbox.MaxMessageBytes)
+			results[rcpt.mailbox.ID] = errMailBoxSizeExceeded
+			oversize = true
+			continue
 		}
 
-		// Parse headers & body to save them later
-		body, headers_raw := ParseData(data, false)
+		recipients = append(recipients, rcpt)
+	}
 
-		if body == "" {
-			// Parse again but this time log out what's happening
-			ParseData(data, true)
+	if oversize && (!s.lmtp || len(recipients) == 0) {
+		return errMailBoxSizeExceeded
+	}
 
-			return nil
-		}
+	if s.lmtp {
+		recipients, err = s.injectDataFaults(faults, recipients, results)
+	} else if len(faults) > 0 {
+		err = s.injectFault(faults[0].rule, faults[0].rcpt.address)
+	}
 
-		// Save mail to the database
-		model := database.Mail{
-			Subject:   decodeMimeHeader(headers.Get("Subject")),
-			From:      s.from,
-			To:        s.to,
-			Body:      body,
-			Headers:   headers_raw,
-			MailBoxID: s.mailbox.ID,
-		}
+	if err != nil || len(recipients) == 0 {
+		return err
+	}
+
+	// The stored copy gets a trace header, like any MTA would add
+	message, err := prepareMessage(append(s.receivedHeader(received_at), b...))
+
+	if err != nil || message == nil {
+		return err
+	}
 
-		db.Create(&model)
+	message.envelope = s.envelope(len(b), received_at)
 
-		// Update mailbox's last email time
-		s.mailbox.LastEmailAt = time.Now()
-		s.mailbox.UnreadCount++
+	if s.user != nil {
+		return captureSubmission(message, s.from, s.user, recipients)
+	}
+
+	if auth_checks {
+		message.authentication = authenticateSender(b, s.remote_ip, s.helo, s.from, message.parsed.From)
+	}
 
-		// Send the new email over socket to clients
-		http.SendSocketMessage("NEW_EMAIL", map[string]interface{}{"mailbox_id": s.mailbox.ID, "email": model})
+	var delivered bool
 
-		db.Save(s.mailbox)
+	for _, rcpt := range recipients {
+		err := deliver(message, s.from, rcpt)
+
+		results[rcpt.mailbox.ID] = err
+		delivered = delivered || err == nil
 	}
+
+	if !delivered {
+		return errDeliveryFailed
+	}
+
 	return nil
 }
 
+// Gets the recipients with a single one per mailbox, so that each gets a single copy
+// even when several recipients lead to it. Captured recipients have no mailbox and are all kept
+func (s *Session) uniqueRecipients() []recipient {
+	var recipients []recipient
+	seen := make(map[string]bool)
+
+	for _, rcpt := range s.recipients {
+		if rcpt.mailbox != nil {
+			if seen[rcpt.mailbox.ID] {
+				continue
+			}
+
+			seen[rcpt.mailbox.ID] = true
+		}
+
+		recipients = append(recipients, rcpt)
+	}
+
+	return recipients
+}
+
 func (s *Session) Reset() {
 	if debug {
 		log.Println("RESET")
 	}
+
+	s.from = ""
+	s.size = 0
+	s.recipients = nil
+	s.endMailBoxSessions()
 }
 
 func (s *Session) Logout() error {
@@ -140,18 +332,36 @@ func (s *Session) Logout() error {
 		log.Println("LOGOUT")
 	}
 
+	s.endMailBoxSessions()
+
 	return nil
 }
 
 func TestMail(from, to, data string) {
-	s := Session{from: from, to: to}
-	s.Data(strings.NewReader(data))
+	s := Session{from: from}
+
+	if s.Rcpt(to) == nil {
+		s.Data(strings.NewReader(data))
+	}
 }
 
 func Init(db_ *gorm.DB) {
 	db = db_
 	debug = Getenv("DEBUG", "false") == "true"
-	server_domain = Getenv("SMTP_DOMAIN", "localhost")
+	// SMTP_DOMAIN holds the domains mail is received for (comma separated), the first one being the server's name
+	domains := strings.Split(Getenv("SMTP_DOMAIN", "localhost"), ",")
+	server_domain = database.NormalizeDomain(domains[0])
+
+	if err := database.EnsureDomains(db, domains); err != nil {
+		log.Println("Error saving domains:", err)
+	}
+	subaddress_separators = Getenv("SMTP_SUBADDRESS_SEPARATORS", "+")
+	auth_checks = Getenv("SMTP_AUTH_CHECKS", "true") == "true"
+
+	// SPF, DKIM and DMARC lookups go to this DNS server rather than the system's
+	if dns_server := Getenv("DNS_RESOLVER", ""); dns_server != "" {
+		Resolver = newDNSResolver(dns_server)
+	}
 
 	be := &Backend{}
 
@@ -159,19 +369,111 @@ func Init(db_ *gorm.DB) {
 
 	s.Addr = fmt.Sprintf(":%s", Getenv("SMTP_PORT", "25"))
 	s.Domain = server_domain
-	s.ReadTimeout = 20 * time.Second
-	s.WriteTimeout = 20 * time.Second
-	s.MaxMessageBytes = 1024 * 1024
-	s.MaxRecipients = 3
+	s.ReadTimeout = getenvDuration("SMTP_READ_TIMEOUT", 20*time.Second)
+	s.WriteTimeout = getenvDuration("SMTP_WRITE_TIMEOUT", 20*time.Second)
+	s.MaxMessageBytes = getenvInt("SMTP_MAX_MESSAGE_BYTES", 25*1024*1024)
+	s.MaxRecipients = getenvInt("SMTP_MAX_RECIPIENTS", 3)
+	s.MaxLineLength = getenvInt("SMTP_MAX_LINE_LENGTH", 2000)
 	s.AllowInsecureAuth = true
+	// 8BITMIME and CHUNKING (BDAT) are always advertised
+	s.EnableSMTPUTF8 = true
+	s.EnableBINARYMIME = true
+
+	// Mailbox limits apply to DATA and BDAT alike, but BDAT chunks over the server's limit are
+	// turned away by go-smtp before the session sees them, so those aren't counted on the mailboxes
+	max_message_bytes = s.MaxMessageBytes
+
+	// Shared by every listener, unlimited when 0
+	limiter := newConnectionLimiter(getenvInt("SMTP_MAX_CONNECTIONS", 0))
+
+	// Clients connecting through a trusted proxy are identified by the PROXY protocol header it sends
+	if Getenv("SMTP_PROXY_PROTOCOL", "false") == "true" {
+		networks, err := proxy.ParseNetworks(Getenv("TRUSTED_PROXIES", ""))
+
+		if err != nil {
+			log.Fatalln("Invalid TRUSTED_PROXIES:", err)
+		}
+
+		trusted_proxies = networks
+	}
+
+	// Rate limits, also unlimited when 0
+	ratelimit.IPs.SetLimits(getenvInt("SMTP_RATE_IP_MESSAGES", 0), getenvInt("SMTP_RATE_IP_SESSIONS", 0))
+	ratelimit.MailBoxes.SetLimits(getenvInt("SMTP_RATE_MAILBOX_MESSAGES", 0), getenvInt("SMTP_RATE_MAILBOX_SESSIONS", 0))
+
+	// STARTTLS is offered once a certificate is configured
+	if cert_path, key_path := Getenv("SMTP_TLS_CERT", ""), Getenv("SMTP_TLS_KEY", ""); cert_path != "" && key_path != "" {
+		reloader, err := newCertReloader(cert_path, key_path)
+
+		if err != nil {
+			log.Fatalln("Error loading TLS certificate:", err)
+		}
+
+		go reloader.watch()
+
+		s.TLSConfig = &tls.Config{GetCertificate: reloader.GetCertificate, MinVersion: tls.VersionTLS12}
+
+		// Implicit TLS (SMTPS) listener
+		if tls_port := Getenv("SMTP_TLS_PORT", ""); tls_port != "" {
+			go serveImplicitTLS(s, fmt.Sprintf(":%s", tls_port), limiter)
+		}
+	}
+
+	// LMTP listener, for delivery from an existing MTA
+	if lmtp_address := Getenv("LMTP_ADDRESS", ""); lmtp_address != "" {
+		go serveLMTP(s, lmtp_address, limiter)
+	}
 
 	DebugPrintln("SMTP Debug enabled")
+
+	listener, err := net.Listen("tcp", s.Addr)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	log.Println("Starting SMTP server at", s.Addr)
-	if err := s.ListenAndServe(); err != nil {
+	if err := s.Serve(wrapListener(listener, limiter)); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func serveImplicitTLS(s *smtp.Server, addr string, limiter *connectionLimiter) {
+	listener, err := net.Listen("tcp", addr)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Println("Starting SMTPS server at", addr)
+	if err := s.Serve(tls.NewListener(wrapListener(listener, limiter), s.TLSConfig)); err != nil {
 		log.Fatal(err)
 	}
 }
 
+// Applies the connection limits and tracks the connections the server accepts,
+// once the client's address is known
+func wrapListener(listener net.Listener, limiter *connectionLimiter) net.Listener {
+	if len(trusted_proxies) > 0 {
+		listener = proxy.NewListener(listener, trusted_proxies)
+	}
+
+	return trackConnections(throttleConnections(limiter.wrap(listener)))
+}
+
+// Gets the IP of a connection's remote address, nil when it has none (e.g. a Unix socket)
+func remoteIP(addr net.Addr) net.IP {
+	if tracked_addr, ok := addr.(trackedAddr); ok {
+		addr = tracked_addr.Addr
+	}
+
+	if tcp_addr, ok := addr.(*net.TCPAddr); ok {
+		return tcp_addr.IP
+	}
+
+	return nil
+}
+
 func Getenv(key, fallback string) string {
 	if env, ok := os.LookupEnv(key); ok {
 		return env
@@ -180,6 +482,40 @@ func Getenv(key, fallback string) string {
 	return fallback
 }
 
+// Gets an integer setting, exits if it's set to something else
+func getenvInt(key string, fallback int) int {
+	value := Getenv(key, "")
+
+	if value == "" {
+		return fallback
+	}
+
+	number, err := strconv.Atoi(value)
+
+	if err != nil || number < 0 {
+		log.Fatalf("Invalid %s: %q\n", key, value)
+	}
+
+	return number
+}
+
+// Gets a duration setting ("20s", "1m"...), exits if it's set to something else
+func getenvDuration(key string, fallback time.Duration) time.Duration {
+	value := Getenv(key, "")
+
+	if value == "" {
+		return fallback
+	}
+
+	duration, err := time.ParseDuration(value)
+
+	if err != nil || duration < 0 {
+		log.Fatalf("Invalid %s: %q\n", key, value)
+	}
+
+	return duration
+}
+
 func DebugPrintln(v ...interface{}) {
 	if debug {
 		log.Println(v...)
@@ -0,0 +1,462 @@
+package smtp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// SPF results (RFC 7208 section 2.6)
+const (
+	spfNone      = "none"
+	spfNeutral   = "neutral"
+	spfPass      = "pass"
+	spfFail      = "fail"
+	spfSoftFail  = "softfail"
+	spfTempError = "temperror"
+	spfPermError = "permerror"
+)
+
+// Maximum number of DNS-querying terms evaluated per check, and of those
+// whose lookup finds nothing ("void lookups", RFC 7208 section 4.6.4)
+const (
+	spfMaxLookups     = 10
+	spfMaxVoidLookups = 2
+)
+
+type spfChecker struct {
+	ctx      context.Context
+	resolver DNSResolver
+	ip       net.IP
+	sender   string
+	helo     string
+	lookups  int
+	voids    int
+}
+
+// Evaluates the sender's SPF policy for the connecting IP, returns the result and the domain checked.
+// Bounces (empty MAIL FROM) are checked against the HELO name instead
+func checkSPF(ctx context.Context, resolver DNSResolver, ip net.IP, sender string, helo string) (string, string) {
+	domain := asciiDomain(addressDomain(sender))
+
+	if domain == "" {
+		domain = asciiDomain(strings.ToLower(helo))
+		sender = "postmaster@" + domain
+	}
+
+	if ip == nil || domain == "" {
+		return spfNone, domain
+	}
+
+	checker := &spfChecker{ctx: ctx, resolver: resolver, ip: ip, sender: sender, helo: helo}
+
+	return checker.checkHost(domain), domain
+}
+
+func (c *spfChecker) checkHost(domain string) string {
+	record, result := c.fetchRecord(domain)
+
+	if result != "" {
+		return result
+	}
+
+	var redirect string
+
+	for _, term := range strings.Fields(record)[1:] {
+		// Modifiers: only redirect matters, exp and unknown ones are ignored
+		if name, value, ok := strings.Cut(term, "="); ok && !strings.ContainsAny(name, ":/") {
+			if strings.EqualFold(name, "redirect") {
+				redirect = value
+			}
+
+			continue
+		}
+
+		qualifier := byte('+')
+
+		if strings.ContainsRune("+-~?", rune(term[0])) {
+			qualifier, term = term[0], term[1:]
+		}
+
+		matched, result := c.matchMechanism(term, domain)
+
+		if result != "" {
+			return result
+		}
+
+		if matched {
+			switch qualifier {
+			case '-':
+				return spfFail
+			case '~':
+				return spfSoftFail
+			case '?':
+				return spfNeutral
+			default:
+				return spfPass
+			}
+		}
+	}
+
+	if redirect != "" {
+		if c.lookups++; c.lookups > spfMaxLookups {
+			return spfPermError
+		}
+
+		if result := c.checkHost(c.expand(redirect, domain)); result != spfNone {
+			return result
+		}
+
+		return spfPermError
+	}
+
+	return spfNeutral
+}
+
+// Gets the domain's SPF record, or the result to return when there's no usable one
+func (c *spfChecker) fetchRecord(domain string) (string, string) {
+	txts, err := c.resolver.LookupTXT(c.ctx, domain)
+
+	if err != nil {
+		if isNotFound(err) {
+			return "", spfNone
+		}
+
+		return "", spfTempError
+	}
+
+	var records []string
+
+	for _, txt := range txts {
+		if strings.EqualFold(txt, "v=spf1") || strings.HasPrefix(strings.ToLower(txt), "v=spf1 ") {
+			records = append(records, txt)
+		}
+	}
+
+	switch len(records) {
+	case 0:
+		return "", spfNone
+	case 1:
+		return records[0], ""
+	default:
+		return "", spfPermError
+	}
+}
+
+// Checks whether a mechanism matches, returns a non-empty result when evaluation must stop with it
+func (c *spfChecker) matchMechanism(term string, domain string) (bool, string) {
+	name := term
+
+	if idx := strings.IndexAny(term, ":/"); idx != -1 {
+		name = term[:idx]
+	}
+
+	args := term[len(name):]
+	name = strings.ToLower(name)
+
+	switch name {
+	case "all":
+		return true, ""
+	case "ip4", "ip6":
+		return c.matchIP(strings.TrimPrefix(args, ":")), ""
+	case "include", "a", "mx", "exists", "ptr":
+		if c.lookups++; c.lookups > spfMaxLookups {
+			return false, spfPermError
+		}
+	default:
+		return false, spfPermError
+	}
+
+	target, cidr4, cidr6, err := parseSPFDomainSpec(args, domain)
+
+	if err != nil {
+		return false, spfPermError
+	}
+
+	target = c.expand(target, domain)
+
+	switch name {
+	case "include":
+		switch c.checkHost(target) {
+		case spfPass:
+			return true, ""
+		case spfTempError:
+			return false, spfTempError
+		case spfPermError, spfNone:
+			return false, spfPermError
+		default:
+			return false, ""
+		}
+	case "a":
+		return c.matchHostIPs(target, cidr4, cidr6, true)
+	case "mx":
+		mxs, err := c.resolver.LookupMX(c.ctx, target)
+
+		if err != nil && !isNotFound(err) {
+			return false, spfTempError
+		}
+
+		if len(mxs) == 0 {
+			return false, c.voidLookup()
+		}
+
+		for i, mx := range mxs {
+			if i == spfMaxLookups {
+				return false, spfPermError
+			}
+
+			if matched, result := c.matchHostIPs(mx.Host, cidr4, cidr6, false); matched || result != "" {
+				return matched, result
+			}
+		}
+
+		return false, ""
+	case "exists":
+		addresses, err := c.resolver.LookupIPAddr(c.ctx, target)
+
+		if err != nil && !isNotFound(err) {
+			return false, spfTempError
+		}
+
+		if len(addresses) == 0 {
+			return false, c.voidLookup()
+		}
+
+		return true, ""
+	}
+
+	// ptr is deprecated (RFC 7208 section 5.5) and never matches here
+	return false, ""
+}
+
+// Checks whether the client IP is one of the host's addresses, within the given prefix lengths.
+// Finding no address counts as a void lookup for the a mechanism, not for each host of an mx one
+func (c *spfChecker) matchHostIPs(host string, cidr4 int, cidr6 int, count_void bool) (bool, string) {
+	addresses, err := c.resolver.LookupIPAddr(c.ctx, host)
+
+	if err != nil && !isNotFound(err) {
+		return false, spfTempError
+	}
+
+	if len(addresses) == 0 && count_void {
+		return false, c.voidLookup()
+	}
+
+	for _, address := range addresses {
+		bits, ones := 128, cidr6
+
+		if address.IP.To4() != nil {
+			bits, ones = 32, cidr4
+		}
+
+		network := net.IPNet{IP: address.IP, Mask: net.CIDRMask(ones, bits)}
+
+		if (address.IP.To4() != nil) == (c.ip.To4() != nil) && network.Contains(c.ip) {
+			return true, ""
+		}
+	}
+
+	return false, ""
+}
+
+// Counts a lookup that found nothing, returns permerror once there were too many
+func (c *spfChecker) voidLookup() string {
+	if c.voids++; c.voids > spfMaxVoidLookups {
+		return spfPermError
+	}
+
+	return ""
+}
+
+func (c *spfChecker) matchIP(spec string) bool {
+	if !strings.Contains(spec, "/") {
+		ip := net.ParseIP(spec)
+		return ip != nil && ip.Equal(c.ip)
+	}
+
+	_, network, err := net.ParseCIDR(spec)
+
+	return err == nil && network.Contains(c.ip)
+}
+
+// Splits the ":domain/cidr4//cidr6" arguments of a mechanism, defaulting to the current domain
+func parseSPFDomainSpec(args string, domain string) (string, int, int, error) {
+	cidr4, cidr6 := 32, 128
+	target := domain
+
+	if strings.HasPrefix(args, ":") {
+		args = args[1:]
+		target = args
+
+		if idx := strings.Index(args, "/"); idx != -1 {
+			target, args = args[:idx], args[idx:]
+		} else {
+			args = ""
+		}
+	}
+
+	if args != "" {
+		v4, v6, _ := strings.Cut(args, "//")
+		var err error
+
+		if v4 = strings.TrimPrefix(v4, "/"); v4 != "" {
+			if cidr4, err = strconv.Atoi(v4); err != nil || cidr4 < 0 || cidr4 > 32 {
+				return "", 0, 0, errors.New("invalid ip4 cidr length")
+			}
+		}
+
+		if v6 != "" {
+			if cidr6, err = strconv.Atoi(v6); err != nil || cidr6 < 0 || cidr6 > 128 {
+				return "", 0, 0, errors.New("invalid ip6 cidr length")
+			}
+		}
+	}
+
+	if target == "" {
+		return "", 0, 0, errors.New("empty domain spec")
+	}
+
+	return target, cidr4, cidr6, nil
+}
+
+// Expands the macros in a domain spec (RFC 7208 section 7)
+func (c *spfChecker) expand(spec string, domain string) string {
+	if !strings.Contains(spec, "%") {
+		return spec
+	}
+
+	local, sender_domain := splitAddress(c.sender)
+
+	var sb strings.Builder
+
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' || i+1 == len(spec) {
+			sb.WriteByte(spec[i])
+			continue
+		}
+
+		i++
+
+		switch spec[i] {
+		case '%':
+			sb.WriteByte('%')
+			continue
+		case '_':
+			sb.WriteByte(' ')
+			continue
+		case '-':
+			sb.WriteString("%20")
+			continue
+		case '{':
+		default:
+			sb.WriteByte('%')
+			sb.WriteByte(spec[i])
+			continue
+		}
+
+		end := strings.IndexByte(spec[i:], '}')
+
+		if end == -1 {
+			sb.WriteString(spec[i-1:])
+			break
+		}
+
+		macro := spec[i+1 : i+end]
+		i += end
+
+		if macro == "" {
+			continue
+		}
+
+		var value string
+
+		switch macro[0] | 0x20 {
+		case 's':
+			value = c.sender
+		case 'l':
+			value = local
+		case 'o':
+			value = sender_domain
+		case 'd':
+			value = domain
+		case 'i':
+			value = spfMacroIP(c.ip)
+		case 'v':
+			value = "in-addr"
+
+			if c.ip.To4() == nil {
+				value = "ip6"
+			}
+		case 'h':
+			value = c.helo
+		default:
+			value = "unknown"
+		}
+
+		sb.WriteString(transformSPFMacro(value, macro[1:]))
+	}
+
+	return sb.String()
+}
+
+// Applies a macro's transformers: keeping the N rightmost parts, reversing, and custom delimiters
+func transformSPFMacro(value string, transformers string) string {
+	digits := 0
+
+	for digits < len(transformers) && transformers[digits] >= '0' && transformers[digits] <= '9' {
+		digits++
+	}
+
+	keep, _ := strconv.Atoi(transformers[:digits])
+	transformers = transformers[digits:]
+
+	reverse := strings.HasPrefix(transformers, "r") || strings.HasPrefix(transformers, "R")
+
+	if reverse {
+		transformers = transformers[1:]
+	}
+
+	delimiters := transformers
+
+	if delimiters == "" {
+		delimiters = "."
+	}
+
+	parts := strings.FieldsFunc(value, func(r rune) bool { return strings.ContainsRune(delimiters, r) })
+
+	if reverse {
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+	}
+
+	if keep > 0 && keep < len(parts) {
+		parts = parts[len(parts)-keep:]
+	}
+
+	return strings.Join(parts, ".")
+}
+
+// IPv4 addresses are dotted, IPv6 ones dot-separated nibbles
+func spfMacroIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+
+	nibbles := make([]string, 0, 32)
+
+	for _, b := range ip.To16() {
+		nibbles = append(nibbles, fmt.Sprintf("%x", b>>4), fmt.Sprintf("%x", b&0xf))
+	}
+
+	return strings.Join(nibbles, ".")
+}
+
+func isNotFound(err error) bool {
+	var dns_err *net.DNSError
+
+	return errors.As(err, &dns_err) && dns_err.IsNotFound
+}
@@ -0,0 +1,467 @@
+package smtp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+)
+
+// Answers lookups from fixed records, names missing from every map don't exist
+// and the ones in failing can't be resolved
+type fakeResolver struct {
+	txt     map[string][]string
+	ips     map[string][]string
+	mx      map[string][]string
+	failing map[string]bool
+}
+
+func (r *fakeResolver) lookup(name string) error {
+	if r.failing[name] {
+		return &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if txts, ok := r.txt[name]; ok {
+		return txts, nil
+	}
+
+	return nil, r.lookup(name)
+}
+
+func (r *fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ips, ok := r.ips[host]
+
+	if !ok {
+		return nil, r.lookup(host)
+	}
+
+	addresses := make([]net.IPAddr, 0, len(ips))
+
+	for _, ip := range ips {
+		addresses = append(addresses, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+
+	return addresses, nil
+}
+
+func (r *fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	hosts, ok := r.mx[name]
+
+	if !ok {
+		return nil, r.lookup(name)
+	}
+
+	mxs := make([]*net.MX, 0, len(hosts))
+
+	for i, host := range hosts {
+		mxs = append(mxs, &net.MX{Host: host, Pref: uint16(10 * (i + 1))})
+	}
+
+	return mxs, nil
+}
+
+// A record with n a mechanisms, each of them resolving to an address that doesn't match
+func spfChain(n int) *fakeResolver {
+	resolver := &fakeResolver{txt: map[string][]string{}, ips: map[string][]string{}}
+	record := "v=spf1"
+
+	for i := 1; i <= n; i++ {
+		host := fmt.Sprintf("h%d.example.com", i)
+		record += " a:" + host
+		resolver.ips[host] = []string{"203.0.113.1"}
+	}
+
+	resolver.txt["example.com"] = []string{record + " -all"}
+
+	return resolver
+}
+
+func TestCheckSPF(t *testing.T) {
+	tests := []struct {
+		name     string
+		resolver *fakeResolver
+		ip       string
+		sender   string
+		helo     string
+		want     string
+	}{
+		{
+			name:     "no record",
+			resolver: &fakeResolver{},
+			ip:       "192.0.2.1",
+			sender:   "alice@example.com",
+			want:     spfNone,
+		},
+		{
+			name:     "ip4 match",
+			resolver: &fakeResolver{txt: map[string][]string{"example.com": {"v=spf1 ip4:192.0.2.1 -all"}}},
+			ip:       "192.0.2.1",
+			sender:   "alice@example.com",
+			want:     spfPass,
+		},
+		{
+			name:     "ip4 mismatch",
+			resolver: &fakeResolver{txt: map[string][]string{"example.com": {"v=spf1 ip4:192.0.2.1 -all"}}},
+			ip:       "192.0.2.2",
+			sender:   "alice@example.com",
+			want:     spfFail,
+		},
+		{
+			name:     "ip4 cidr",
+			resolver: &fakeResolver{txt: map[string][]string{"example.com": {"v=spf1 ip4:192.0.2.0/24 -all"}}},
+			ip:       "192.0.2.200",
+			sender:   "alice@example.com",
+			want:     spfPass,
+		},
+		{
+			name:     "ip4 outside cidr",
+			resolver: &fakeResolver{txt: map[string][]string{"example.com": {"v=spf1 ip4:192.0.2.0/24 ~all"}}},
+			ip:       "192.0.3.1",
+			sender:   "alice@example.com",
+			want:     spfSoftFail,
+		},
+		{
+			name:     "ip6 cidr",
+			resolver: &fakeResolver{txt: map[string][]string{"example.com": {"v=spf1 ip6:2001:db8::/32 -all"}}},
+			ip:       "2001:db8:1234::1",
+			sender:   "alice@example.com",
+			want:     spfPass,
+		},
+		{
+			name:     "ip6 outside cidr",
+			resolver: &fakeResolver{txt: map[string][]string{"example.com": {"v=spf1 ip6:2001:db8::/32 -all"}}},
+			ip:       "2001:db9::1",
+			sender:   "alice@example.com",
+			want:     spfFail,
+		},
+		{
+			name:     "ip6 mechanism with an ipv4 client",
+			resolver: &fakeResolver{txt: map[string][]string{"example.com": {"v=spf1 ip6:::/0 ?all"}}},
+			ip:       "192.0.2.1",
+			sender:   "alice@example.com",
+			want:     spfNeutral,
+		},
+		{
+			name: "include pass",
+			resolver: &fakeResolver{txt: map[string][]string{
+				"example.com":      {"v=spf1 include:_spf.example.net -all"},
+				"_spf.example.net": {"v=spf1 ip4:198.51.100.0/24 -all"},
+			}},
+			ip:     "198.51.100.5",
+			sender: "alice@example.com",
+			want:   spfPass,
+		},
+		{
+			name: "include fail doesn't match",
+			resolver: &fakeResolver{txt: map[string][]string{
+				"example.com":      {"v=spf1 include:_spf.example.net ?all"},
+				"_spf.example.net": {"v=spf1 ip4:198.51.100.0/24 -all"},
+			}},
+			ip:     "203.0.113.1",
+			sender: "alice@example.com",
+			want:   spfNeutral,
+		},
+		{
+			name:     "include without record",
+			resolver: &fakeResolver{txt: map[string][]string{"example.com": {"v=spf1 include:_spf.example.net -all"}}},
+			ip:       "192.0.2.1",
+			sender:   "alice@example.com",
+			want:     spfPermError,
+		},
+		{
+			name: "redirect",
+			resolver: &fakeResolver{txt: map[string][]string{
+				"example.com":      {"v=spf1 redirect=_spf.example.net"},
+				"_spf.example.net": {"v=spf1 ip4:198.51.100.0/24 -all"},
+			}},
+			ip:     "203.0.113.1",
+			sender: "alice@example.com",
+			want:   spfFail,
+		},
+		{
+			name: "redirect ignored after a match",
+			resolver: &fakeResolver{txt: map[string][]string{
+				"example.com":      {"v=spf1 ip4:203.0.113.1 redirect=_spf.example.net"},
+				"_spf.example.net": {"v=spf1 -all"},
+			}},
+			ip:     "203.0.113.1",
+			sender: "alice@example.com",
+			want:   spfPass,
+		},
+		{
+			name:     "redirect without record",
+			resolver: &fakeResolver{txt: map[string][]string{"example.com": {"v=spf1 redirect=_spf.example.net"}}},
+			ip:       "192.0.2.1",
+			sender:   "alice@example.com",
+			want:     spfPermError,
+		},
+		{
+			name: "a dual cidr ipv4",
+			resolver: &fakeResolver{
+				txt: map[string][]string{"example.com": {"v=spf1 a:mail.example.com/24//64 -all"}},
+				ips: map[string][]string{"mail.example.com": {"192.0.2.10", "2001:db8::10"}},
+			},
+			ip:     "192.0.2.99",
+			sender: "alice@example.com",
+			want:   spfPass,
+		},
+		{
+			name: "a dual cidr ipv6",
+			resolver: &fakeResolver{
+				txt: map[string][]string{"example.com": {"v=spf1 a:mail.example.com/24//64 -all"}},
+				ips: map[string][]string{"mail.example.com": {"192.0.2.10", "2001:db8::10"}},
+			},
+			ip:     "2001:db8::ffff:1",
+			sender: "alice@example.com",
+			want:   spfPass,
+		},
+		{
+			name: "a dual cidr ipv6 outside",
+			resolver: &fakeResolver{
+				txt: map[string][]string{"example.com": {"v=spf1 a:mail.example.com/24//64 -all"}},
+				ips: map[string][]string{"mail.example.com": {"192.0.2.10", "2001:db8::10"}},
+			},
+			ip:     "2001:db8:0:1::10",
+			sender: "alice@example.com",
+			want:   spfFail,
+		},
+		{
+			name: "a of the current domain",
+			resolver: &fakeResolver{
+				txt: map[string][]string{"example.com": {"v=spf1 a -all"}},
+				ips: map[string][]string{"example.com": {"192.0.2.10"}},
+			},
+			ip:     "192.0.2.10",
+			sender: "alice@example.com",
+			want:   spfPass,
+		},
+		{
+			name: "mx cidr",
+			resolver: &fakeResolver{
+				txt: map[string][]string{"example.com": {"v=spf1 mx/24 -all"}},
+				mx:  map[string][]string{"example.com": {"mx1.example.com", "mx2.example.com"}},
+				ips: map[string][]string{"mx1.example.com": {"192.0.2.10"}, "mx2.example.com": {"203.0.113.10"}},
+			},
+			ip:     "203.0.113.77",
+			sender: "alice@example.com",
+			want:   spfPass,
+		},
+		{
+			name: "mx dual cidr ipv6",
+			resolver: &fakeResolver{
+				txt: map[string][]string{"example.com": {"v=spf1 mx:example.net/32//48 -all"}},
+				mx:  map[string][]string{"example.net": {"mx.example.net"}},
+				ips: map[string][]string{"mx.example.net": {"192.0.2.10", "2001:db8:1::10"}},
+			},
+			ip:     "2001:db8:1:ff::1",
+			sender: "alice@example.com",
+			want:   spfPass,
+		},
+		{
+			name: "mx outside cidr",
+			resolver: &fakeResolver{
+				txt: map[string][]string{"example.com": {"v=spf1 mx/32 -all"}},
+				mx:  map[string][]string{"example.com": {"mx1.example.com"}},
+				ips: map[string][]string{"mx1.example.com": {"192.0.2.10"}},
+			},
+			ip:     "192.0.2.11",
+			sender: "alice@example.com",
+			want:   spfFail,
+		},
+		{
+			name:     "ten lookups",
+			resolver: spfChain(10),
+			ip:       "192.0.2.1",
+			sender:   "alice@example.com",
+			want:     spfFail,
+		},
+		{
+			name:     "eleven lookups",
+			resolver: spfChain(11),
+			ip:       "192.0.2.1",
+			sender:   "alice@example.com",
+			want:     spfPermError,
+		},
+		{
+			name: "lookups counted across includes",
+			resolver: func() *fakeResolver {
+				resolver := spfChain(9)
+				resolver.txt["example.com"][0] = "v=spf1 include:example.net -all"
+				resolver.txt["example.net"] = []string{"v=spf1 redirect=example.org"}
+				resolver.txt["example.org"] = []string{"v=spf1 a:h1.example.com a:h2.example.com a:h3.example.com a:h4.example.com a:h5.example.com a:h6.example.com a:h7.example.com a:h8.example.com a:h9.example.com -all"}
+
+				return resolver
+			}(),
+			ip:     "192.0.2.1",
+			sender: "alice@example.com",
+			want:   spfPermError,
+		},
+		{
+			name:     "two void lookups",
+			resolver: &fakeResolver{txt: map[string][]string{"example.com": {"v=spf1 a:n1.example.com mx:n2.example.com -all"}}},
+			ip:       "192.0.2.1",
+			sender:   "alice@example.com",
+			want:     spfFail,
+		},
+		{
+			name: "three void lookups",
+			resolver: &fakeResolver{
+				txt: map[string][]string{"example.com": {"v=spf1 a:n1.example.com mx:n2.example.com exists:n3.example.com -all"}},
+				ips: map[string][]string{"n3.example.com": {}},
+			},
+			ip:     "192.0.2.1",
+			sender: "alice@example.com",
+			want:   spfPermError,
+		},
+		{
+			name: "macros",
+			resolver: &fakeResolver{
+				txt: map[string][]string{"email.example.com": {"v=spf1 exists:%{ir}.%{l1r-}.%{o2}._spf.%{d2} -all"}},
+				ips: map[string][]string{"3.2.0.192.strong.example.com._spf.example.com": {"127.0.0.2"}},
+			},
+			ip:     "192.0.2.3",
+			sender: "strong-bad@email.example.com",
+			want:   spfPass,
+		},
+		{
+			name: "macros of another sender",
+			resolver: &fakeResolver{
+				txt: map[string][]string{"email.example.com": {"v=spf1 exists:%{ir}.%{l1r-}.%{o2}._spf.%{d2} -all"}},
+				ips: map[string][]string{"3.2.0.192.strong.example.com._spf.example.com": {"127.0.0.2"}},
+			},
+			ip:     "192.0.2.3",
+			sender: "weak-bad@email.example.com",
+			want:   spfFail,
+		},
+		{
+			name: "ipv6 macro",
+			resolver: &fakeResolver{
+				txt: map[string][]string{"example.com": {"v=spf1 exists:%{ir}.%{v}._spf.%{d} -all"}},
+				ips: map[string][]string{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6._spf.example.com": {"127.0.0.2"}},
+			},
+			ip:     "2001:db8::1",
+			sender: "alice@example.com",
+			want:   spfPass,
+		},
+		{
+			name: "helo without sender",
+			resolver: &fakeResolver{
+				txt: map[string][]string{"mail.example.com": {"v=spf1 exists:%{l}.%{h} -all"}},
+				ips: map[string][]string{"postmaster.mail.example.com": {"127.0.0.2"}},
+			},
+			ip:   "192.0.2.1",
+			helo: "mail.example.com",
+			want: spfPass,
+		},
+		{
+			name:     "multiple records",
+			resolver: &fakeResolver{txt: map[string][]string{"example.com": {"v=spf1 +all", "v=spf1 -all"}}},
+			ip:       "192.0.2.1",
+			sender:   "alice@example.com",
+			want:     spfPermError,
+		},
+		{
+			name:     "other txt records",
+			resolver: &fakeResolver{txt: map[string][]string{"example.com": {"google-site-verification=x", "v=spf10 -all", "v=spf1 +all"}}},
+			ip:       "192.0.2.1",
+			sender:   "alice@example.com",
+			want:     spfPass,
+		},
+		{
+			name:     "unknown mechanism",
+			resolver: &fakeResolver{txt: map[string][]string{"example.com": {"v=spf1 ip5:192.0.2.1 -all"}}},
+			ip:       "192.0.2.1",
+			sender:   "alice@example.com",
+			want:     spfPermError,
+		},
+		{
+			name:     "record lookup failure",
+			resolver: &fakeResolver{failing: map[string]bool{"example.com": true}},
+			ip:       "192.0.2.1",
+			sender:   "alice@example.com",
+			want:     spfTempError,
+		},
+		{
+			name: "include lookup failure",
+			resolver: &fakeResolver{
+				txt:     map[string][]string{"example.com": {"v=spf1 include:_spf.example.net -all"}},
+				failing: map[string]bool{"_spf.example.net": true},
+			},
+			ip:     "192.0.2.1",
+			sender: "alice@example.com",
+			want:   spfTempError,
+		},
+		{
+			name: "a lookup failure",
+			resolver: &fakeResolver{
+				txt:     map[string][]string{"example.com": {"v=spf1 a:mail.example.com -all"}},
+				failing: map[string]bool{"mail.example.com": true},
+			},
+			ip:     "192.0.2.1",
+			sender: "alice@example.com",
+			want:   spfTempError,
+		},
+		{
+			name: "mx host lookup failure",
+			resolver: &fakeResolver{
+				txt:     map[string][]string{"example.com": {"v=spf1 mx -all"}},
+				mx:      map[string][]string{"example.com": {"mx1.example.com"}},
+				failing: map[string]bool{"mx1.example.com": true},
+			},
+			ip:     "192.0.2.1",
+			sender: "alice@example.com",
+			want:   spfTempError,
+		},
+		{
+			name: "failure after a match",
+			resolver: &fakeResolver{
+				txt:     map[string][]string{"example.com": {"v=spf1 ip4:192.0.2.1 a:mail.example.com -all"}},
+				failing: map[string]bool{"mail.example.com": true},
+			},
+			ip:     "192.0.2.1",
+			sender: "alice@example.com",
+			want:   spfPass,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, _ := checkSPF(context.Background(), test.resolver, net.ParseIP(test.ip), test.sender, test.helo)
+
+			if result != test.want {
+				t.Errorf("got %s, want %s", result, test.want)
+			}
+		})
+	}
+}
+
+// Examples from RFC 7208 section 7.4
+func TestTransformSPFMacro(t *testing.T) {
+	tests := []struct {
+		value        string
+		transformers string
+		want         string
+	}{
+		{"email.example.com", "", "email.example.com"},
+		{"email.example.com", "4", "email.example.com"},
+		{"email.example.com", "3", "email.example.com"},
+		{"email.example.com", "2", "example.com"},
+		{"email.example.com", "1", "com"},
+		{"email.example.com", "r", "com.example.email"},
+		{"email.example.com", "2r", "example.email"},
+		{"strong-bad", "-", "strong.bad"},
+		{"strong-bad", "r-", "bad.strong"},
+		{"strong-bad", "1r-", "strong"},
+		{"192.0.2.3", "r", "3.2.0.192"},
+	}
+
+	for _, test := range tests {
+		if got := transformSPFMacro(test.value, test.transformers); got != test.want {
+			t.Errorf("transformSPFMacro(%q, %q) = %q, want %q", test.value, test.transformers, got, test.want)
+		}
+	}
+}
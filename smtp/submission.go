@@ -0,0 +1,104 @@
+package smtp
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"sync"
+
+	"gotemp/database"
+	"gotemp/http"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// Checks an SMTP user's credentials
+func authenticateUser(username string, password string) (*database.SMTPUser, bool) {
+	var user database.SMTPUser
+
+	if q := db.Where("username = ?", username).Limit(1).Find(&user); q.RowsAffected == 0 {
+		return nil, false
+	}
+
+	if err := bcrypt.CompareHashAndPassword(user.PasswordHash, []byte(password)); err != nil {
+		return nil, false
+	}
+
+	return &user, true
+}
+
+// Serializes the creation of capture mailboxes, so a user's concurrent submissions share one
+var capture_lock sync.Mutex
+
+// Gets the mailbox mail submitted by the user is captured into: the one they're bound to, or
+// else a capture mailbox made for them (and bound to them) on their first submission
+func captureMailbox(user *database.SMTPUser) (*database.MailBox, error) {
+	capture_lock.Lock()
+	defer capture_lock.Unlock()
+
+	var mailbox database.MailBox
+
+	// Another session may have bound the user since they logged in
+	if q := db.Where("id = ?", user.ID).Limit(1).Find(user); q.RowsAffected == 0 {
+		return nil, errors.New("SMTP user not found")
+	}
+
+	if user.MailBoxID != nil {
+		if q := db.Where("id = ?", *user.MailBoxID).Limit(1).Find(&mailbox); q.RowsAffected == 0 {
+			return nil, errors.New("capture mailbox not found")
+		}
+
+		return &mailbox, nil
+	}
+
+	if err := database.ValidateSMTPUsername(user.Username); err != nil {
+		return nil, err
+	}
+
+	// Captured mail is kept for as long as the mailbox exists, it's never routed mail from outside
+	mailbox = database.MailBox{
+		Name:      "SMTP: " + user.Username,
+		Address:   database.NormalizeAddress(user.Username),
+		MatchType: database.MatchExact,
+		Capture:   true,
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&mailbox).Error; err != nil {
+			return err
+		}
+
+		return tx.Model(user).Update("mail_box_id", mailbox.ID).Error
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	user.MailBoxID = &mailbox.ID
+
+	log.Println("Created capture mailbox for SMTP user " + user.Username)
+	http.SendSocketMessage("MAILBOX_CREATED", mailbox)
+
+	return &mailbox, nil
+}
+
+// Delivers mail submitted by an authenticated user into their capture mailbox,
+// as a single copy listing every recipient
+func captureSubmission(message *incomingMessage, from string, user *database.SMTPUser, recipients []recipient) error {
+	mailbox, err := captureMailbox(user)
+
+	if err != nil {
+		log.Println("Error finding capture mailbox:", err)
+		return errors.New("couldn't capture message")
+	}
+
+	addresses := make([]string, 0, len(recipients))
+
+	for _, rcpt := range recipients {
+		addresses = append(addresses, rcpt.address)
+	}
+
+	return deliver(message, from, recipient{address: strings.Join(addresses, ", "), mailbox: mailbox})
+}
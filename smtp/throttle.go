@@ -0,0 +1,108 @@
+package smtp
+
+import (
+	"log"
+	"net"
+	"sync"
+
+	"gotemp/database"
+	"gotemp/ratelimit"
+
+	"github.com/emersion/go-smtp"
+)
+
+var (
+	errIPRateExceeded = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+		Message:      "Too many messages from your IP, try again later",
+	}
+	errMailBoxRateExceeded = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+		Message:      "Too many messages for this mailbox, try again later",
+	}
+	errMailBoxBusy = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+		Message:      "Too many concurrent deliveries to this mailbox, try again later",
+	}
+)
+
+// Caps the concurrent sessions of each client IP, the ones over it are turned away with a 421
+type throttleListener struct {
+	net.Listener
+}
+
+func throttleConnections(listener net.Listener) net.Listener {
+	return throttleListener{Listener: listener}
+}
+
+func (l throttleListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+
+		if err != nil {
+			return nil, err
+		}
+
+		ip := remoteIP(conn.RemoteAddr())
+
+		// Local (Unix socket) clients aren't throttled
+		if ip == nil {
+			return conn, nil
+		}
+
+		key := ip.String()
+
+		if ratelimit.IPs.StartSession(key) {
+			return &throttledConn{Conn: conn, key: key}, nil
+		}
+
+		log.Println("Too many sessions, turning away", conn.RemoteAddr())
+		turnAway(conn, "Too many sessions from your IP, try again later")
+	}
+}
+
+// Ends its session once closed
+type throttledConn struct {
+	net.Conn
+	key  string
+	once sync.Once
+}
+
+func (c *throttledConn) Close() error {
+	c.once.Do(func() { ratelimit.IPs.EndSession(c.key) })
+
+	return c.Conn.Close()
+}
+
+// Counts a delivery to the mailbox, starting a session for it the first time in the transaction
+func (s *Session) throttleMailBox(mailbox *database.MailBox) error {
+	for _, id := range s.mailbox_sessions {
+		if id == mailbox.ID {
+			return nil
+		}
+	}
+
+	if !ratelimit.MailBoxes.StartSession(mailbox.ID) {
+		return errMailBoxBusy
+	}
+
+	s.mailbox_sessions = append(s.mailbox_sessions, mailbox.ID)
+
+	if !ratelimit.MailBoxes.AllowMessage(mailbox.ID) {
+		return errMailBoxRateExceeded
+	}
+
+	return nil
+}
+
+// Ends the sessions started for the transaction's mailboxes
+func (s *Session) endMailBoxSessions() {
+	for _, id := range s.mailbox_sessions {
+		ratelimit.MailBoxes.EndSession(id)
+	}
+
+	s.mailbox_sessions = nil
+}
@@ -0,0 +1,97 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Keeps the TLS certificate in memory, reloading it on SIGHUP or when its files change
+// so renewed certificates are used without restarting
+type certReloader struct {
+	cert_path string
+	key_path  string
+
+	mutex    sync.RWMutex
+	cert     *tls.Certificate
+	mod_time time.Time
+}
+
+func newCertReloader(cert_path string, key_path string) (*certReloader, error) {
+	reloader := &certReloader{cert_path: cert_path, key_path: key_path}
+
+	if err := reloader.load(); err != nil {
+		return nil, err
+	}
+
+	return reloader, nil
+}
+
+func (r *certReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(r.cert_path, r.key_path)
+
+	if err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	r.cert = &cert
+	r.mod_time = r.filesModTime()
+	r.mutex.Unlock()
+
+	return nil
+}
+
+// Gets the latest modification time of the certificate and key files
+func (r *certReloader) filesModTime() time.Time {
+	var latest time.Time
+
+	for _, path := range []string{r.cert_path, r.key_path} {
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+
+	return latest
+}
+
+func (r *certReloader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.cert, nil
+}
+
+// Reloads the certificate on SIGHUP and checks the files for changes every minute,
+// a broken certificate is logged and the previous one kept
+func (r *certReloader) watch() {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+
+	ticker := time.NewTicker(time.Minute)
+
+	for {
+		select {
+		case <-sighup:
+			log.Println("SIGHUP received, reloading TLS certificate")
+		case <-ticker.C:
+			r.mutex.RLock()
+			changed := r.filesModTime().After(r.mod_time)
+			r.mutex.RUnlock()
+
+			if !changed {
+				continue
+			}
+
+			log.Println("TLS certificate files changed, reloading")
+		}
+
+		if err := r.load(); err != nil {
+			log.Println("Error reloading TLS certificate:", err)
+		}
+	}
+}